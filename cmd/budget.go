@@ -0,0 +1,62 @@
+// Copyright © 2016 Jörg Ramb <jorg@jramb.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"database/sql"
+	"github.com/jramb/p/tools"
+	"github.com/spf13/cobra"
+)
+
+var budgetCmd = &cobra.Command{
+	Use:   "budget [header]",
+	Short: "show the time budgets",
+	Long: `Shows the budget of every header that has one (or of the given header):
+the time used so far (sub-headers included), what is left, the burn rate of the
+last budget.burn-days (default 28) and when the budget runs out at that rate.
+
+'in' and 'switch' warn when a header has used budget.warn-threshold percent
+(default 90, 0 turns it off) of its budget.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithOpenDB(true, func(db *sql.DB) error {
+			return tools.ShowBudgets(db, tools.FirstOrEmpty(args))
+		})
+	},
+}
+
+var budgetSetCmd = &cobra.Command{
+	Use:   "set <header> <budget>",
+	Short: "set the time budget of a header",
+	Long: `Sets the time budget of a header, e.g. 40h or 40 (hours). 0 removes the budget.
+Same as 'head set <header> budget=<budget>'.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			return tools.SetHeaderAttributes(tx, args[0], []string{"budget=" + args[1]})
+		})
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(budgetCmd)
+	budgetCmd.AddCommand(budgetSetCmd)
+}
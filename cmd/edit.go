@@ -0,0 +1,92 @@
+// Copyright © 2016 Jörg Ramb <jorg@jramb.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"database/sql"
+	"github.com/jramb/p/tools"
+	"github.com/spf13/cobra"
+)
+
+var editStart string
+var editEnd string
+var editHeader string
+
+// editCmd represents the edit command
+var editCmd = &cobra.Command{
+	Use:   "edit [last|nn]",
+	Short: "correct an existing time entry",
+	Long: `Changes start, end or header of an existing time entry.
+The entry is given by its number (see 'edit list') or 'last' for the latest entry.
+Without any flags the entry is only shown.
+
+Times are given as HH:MM (on the day of the entry) or as YYYY-MM-DD HH:MM, e.g.
+
+p edit last --end 17:30
+p edit 1234 --start 09:10 --end 11:45 --header @dev
+
+The entry may not overlap with any other entry.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			id, err := tools.FindEntryId(tx, tools.FirstOrEmpty(args))
+			if err != nil {
+				return err
+			}
+			return tools.EditEntry(tx, id, editStart, editEnd, editHeader, GetEffectiveTime())
+		})
+	},
+}
+
+var editDeleteCmd = &cobra.Command{
+	Use:   "delete [last|nn]",
+	Short: "delete a time entry",
+	Long:  `Deletes the given time entry completely.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			id, err := tools.FindEntryId(tx, tools.FirstOrEmpty(args))
+			if err != nil {
+				return err
+			}
+			return tools.DeleteEntry(tx, id)
+		})
+	},
+}
+
+var editListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list time entries with their numbers",
+	Long: `Lists the time entries of a time-frame (default: week) together with
+the entry numbers needed by 'edit'.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithOpenDB(true, func(db *sql.DB) error {
+			return tools.ListEntries(db, args)
+		})
+	},
+}
+
+func init() {
+	editCmd.Flags().StringVarP(&editStart, "start", "", "", "new start time (HH:MM or YYYY-MM-DD HH:MM)")
+	editCmd.Flags().StringVarP(&editEnd, "end", "", "", "new end time (HH:MM or YYYY-MM-DD HH:MM)")
+	editCmd.Flags().StringVarP(&editHeader, "header", "", "", "move the entry to this header (@handle or part of header)")
+	RootCmd.AddCommand(editCmd)
+	editCmd.AddCommand(editDeleteCmd)
+	editCmd.AddCommand(editListCmd)
+}
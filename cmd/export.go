@@ -0,0 +1,86 @@
+// Copyright © 2016 Jörg Ramb <jorg@jramb.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"database/sql"
+	"os"
+
+	"github.com/jramb/p/tools"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export the time data to other formats",
+	Long:  `Exports the time data to other formats.`,
+}
+
+var exportJSONCmd = &cobra.Command{
+	Use:   "json [file]",
+	Short: "export the complete clockfile as JSON",
+	Long: `Exports the complete clockfile (headers, entries, logs, TODOs and parameters)
+as JSON to the given file or to stdout. The result can be read by 'import json',
+for example to move the data to another machine or to keep a backup.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithOpenDB(true, func(db *sql.DB) error {
+			file := tools.FirstOrEmpty(args)
+			if file == "" || file == "-" {
+				return tools.ExportJSON(db, os.Stdout)
+			}
+			f, err := os.Create(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return tools.ExportJSON(db, f)
+		})
+	},
+}
+
+var exportICSCmd = &cobra.Command{
+	Use:   "ics [timeframe] [filter]",
+	Short: "export the time entries as iCalendar",
+	Long: `Exports the time entries of the time frame (default is the current week) as
+iCalendar events to stdout, for example to show the tracked time in a calendar
+next to the planned meetings. The event description holds the log lines
+written during the entry. The same is served by 'p server' on /calendar.ics.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithOpenDB(true, func(db *sql.DB) error {
+			from, to, err := tools.DecodeTimeFrame(tools.FirstOrEmpty(args))
+			if err != nil {
+				return err
+			}
+			var filter string
+			if len(args) > 1 {
+				filter = args[1]
+			}
+			return tools.ExportICS(db, os.Stdout, from, to, filter)
+		})
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+	exportCmd.AddCommand(exportJSONCmd)
+	exportCmd.AddCommand(exportICSCmd)
+}
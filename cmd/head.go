@@ -36,21 +36,27 @@ var headCmd = &cobra.Command{
 You need to have a header to create time entries.`,
 }
 
+var headListAll bool
+
 var headListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "Lists all active headers",
-	Long:  `Lists all active headers.`,
+	Long:  `Lists all active headers, with --all also the archived ones.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return tools.WithOpenDB(true, func(db *sql.DB) error {
-			return tools.ShowHeaders(db, args)
+			return tools.ShowHeaders(db, args, headListAll)
 		})
 	},
 }
 
+var headAddParent string
+
 var headAddCmd = &cobra.Command{
 	Use:   "add",
 	Short: "add a new header",
-	Long:  `Adds a new header.`,
+	Long: `Adds a new header. With --parent (or a title like "Customer:Project") it
+becomes a sub-header, the reports show it as Parent:Child and with --subheaders
+the parents get the subtotals.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
 			handle, args := tools.ParseHandle(args)
@@ -58,14 +64,110 @@ var headAddCmd = &cobra.Command{
 				return fmt.Errorf("handler '%s' does already exist", handle)
 			}
 
-			_, err := tools.AddHeader(tx, strings.Join(args, " "), handle)
+			_, err := tools.AddHeader(tx, strings.Join(args, " "), handle, headAddParent)
 			return err
 		})
 	},
 }
 
+var headRenameCmd = &cobra.Command{
+	Use:   "rename <header> <new title>",
+	Short: "change the title of a header",
+	Long: `Changes the title of a header. The header is given as @handle, as the number
+shown by 'head list' or as a unique part of the title.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			return tools.RenameHeader(tx, args[0], strings.Join(args[1:], " "))
+		})
+	},
+}
+
+var headHandleCmd = &cobra.Command{
+	Use:   "handle <header> <new handle>",
+	Short: "change the handle of a header",
+	Long: `Gives a header a new handle (or one if it had none yet).
+The TODOs of the old handle are moved to the new one.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			return tools.ChangeHandle(tx, args[0], args[1])
+		})
+	},
+}
+
+var headArchiveCmd = &cobra.Command{
+	Use:   "archive <header>",
+	Short: "archive a finished header",
+	Long: `Archives a header, for example of a finished project. Archived headers are
+left out of the lists and reports and can not be punched into, their entries are kept.
+'head list --all' shows them, 'head unarchive' brings them back.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			return tools.SetHeaderActive(tx, args[0], false)
+		})
+	},
+}
+
+var headUnarchiveCmd = &cobra.Command{
+	Use:   "unarchive <header>",
+	Short: "reactivate an archived header",
+	Long:  `Makes an archived header active again.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			return tools.SetHeaderActive(tx, args[0], true)
+		})
+	},
+}
+
+var headMergeCmd = &cobra.Command{
+	Use:   "merge <from> <into>",
+	Short: "merge a header into another one",
+	Long: `Moves all entries, logs and TODOs of the first header to the second one
+and archives the first. The merge is synchronized: entries of the old header
+that are synced later from another machine are moved as well.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			return tools.MergeHeaders(tx, args[0], args[1])
+		})
+	},
+}
+
+var headSetCmd = &cobra.Command{
+	Use:   "set <header> [key=value...]",
+	Short: "set the billing attributes of a header",
+	Long: `Sets the attributes of a header, used by 'show bill':
+
+  client=Customer X   the client to bill
+  billable=yes        yes or no
+  rate=95             hourly rate
+  currency=EUR        currency of the rate
+  budget=40h          time budget (or a number of hours)
+
+An empty value (e.g. client=) removes the attribute, sub-headers inherit client,
+billable, rate and currency from their parent. Without key=value the attributes
+are shown.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			return tools.SetHeaderAttributes(tx, args[0], args[1:])
+		})
+	},
+}
+
 func init() {
 	RootCmd.AddCommand(headCmd)
 	headCmd.AddCommand(headAddCmd)
+	headAddCmd.Flags().StringVarP(&headAddParent, "parent", "p", "", "the parent header (@handle, number or part of the title)")
 	headCmd.AddCommand(headListCmd)
+	headListCmd.Flags().BoolVarP(&headListAll, "all", "a", false, "include the archived headers")
+	headCmd.AddCommand(headRenameCmd)
+	headCmd.AddCommand(headHandleCmd)
+	headCmd.AddCommand(headArchiveCmd)
+	headCmd.AddCommand(headUnarchiveCmd)
+	headCmd.AddCommand(headMergeCmd)
+	headCmd.AddCommand(headSetCmd)
 }
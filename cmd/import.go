@@ -0,0 +1,124 @@
+// Copyright © 2016 Jörg Ramb <jorg@jramb.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"database/sql"
+	"os"
+
+	"github.com/jramb/p/tools"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var importDryRun bool
+var importICSMap []string
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "import time entries from other formats",
+	Long:  `Imports time entries and headers from other tools and formats.`,
+}
+
+var importOrgCmd = &cobra.Command{
+	Use:   "org <file>",
+	Short: "import CLOCK entries from an Emacs org-mode file",
+	Long: `Imports the CLOCK entries of an Emacs org-mode file.
+
+Nested org headers become headers named A:B:C (see --subheaders),
+missing headers are created. Entries that already exist (same header and start)
+are skipped, so the same file can be imported again later.
+Use --dry-run to see what would be imported.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			return tools.ImportOrgFile(tx, args[0], importDryRun)
+		})
+	},
+}
+
+var importJSONCmd = &cobra.Command{
+	Use:   "json <file>",
+	Short: "import a JSON export",
+	Long: `Imports a file written by 'export json' (use - for stdin).
+Headers, entries, logs and TODOs are inserted or updated by their UUID,
+nothing is deleted. This can be used to restore a backup or to move data between machines.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			if args[0] == "-" {
+				return tools.ImportJSON(tx, os.Stdin)
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return tools.ImportJSON(tx, f)
+		})
+	},
+}
+
+var importICSCmd = &cobra.Command{
+	Use:   "ics <file> [timeframe]",
+	Short: "import meetings from an iCalendar file",
+	Long: `Adds the meetings of an iCalendar (.ics) file as entries, by default those of
+the current week. Mapping rules decide the header of an event: the pattern is
+searched in the summary (or with category: in the categories), the first
+matching rule wins. Events without a matching rule are skipped, as are all-day
+and cancelled events and those overlapping existing entries.
+
+p import ics calendar.ics week-1 --map "Standup=@scrum" --map "category:Customer X=Customer X"
+
+The rules can be kept in the config file as well, they are used after --map:
+
+[ics]
+map = ["Standup=@scrum", "Retro=@scrum"]
+
+Use --dry-run to see what would be imported.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, to, err := tools.DecodeTimeFrame(tools.FirstOrEmpty(args[1:]))
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rules := append(importICSMap, viper.GetStringSlice("ics.map")...)
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			return tools.ImportICS(tx, f, from, to, rules, importDryRun, GetEffectiveTime())
+		})
+	},
+}
+
+func init() {
+	importOrgCmd.Flags().BoolVarP(&importDryRun, "dry-run", "n", false, "only show what would be imported")
+	RootCmd.AddCommand(importCmd)
+	importCmd.AddCommand(importOrgCmd)
+	importCmd.AddCommand(importJSONCmd)
+	importICSCmd.Flags().BoolVarP(&importDryRun, "dry-run", "n", false, "only show what would be imported")
+	importICSCmd.Flags().StringArrayVar(&importICSMap, "map", nil, "mapping rule Pattern=@handle or Pattern=header (repeatable)")
+	importCmd.AddCommand(importICSCmd)
+}
@@ -0,0 +1,81 @@
+// Copyright © 2016 Jörg Ramb <jorg@jramb.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"database/sql"
+
+	"github.com/jramb/p/tools"
+	"github.com/spf13/cobra"
+)
+
+var mqttCmd = &cobra.Command{
+	Use:   "mqtt",
+	Short: "MQTT integration",
+	Long: `If mqtt.broker is configured, punch publishes the current state as retained JSON to
+<mqtt.topic-prefix>/<mqtt.username>/state whenever the running entry changes:
+
+{"state":"on","handle":"dev","header":"Development","start":"...","elapsed":1260,"today":9000,"updated":"..."}
+
+elapsed (of the running entry) and today are in seconds. More settings in [mqtt]:
+qos (0, 1 or 2), tls-ca, tls-cert, tls-key and tls-insecure (use an ssl:// broker URL),
+discovery = true to announce the state as Home Assistant sensors (discovery-prefix,
+default homeassistant) and interval for 'mqtt listen'.`,
+}
+
+var mqttPublishCmd = &cobra.Command{
+	Use:   "publish",
+	Short: "publish the current state now",
+	Long:  `Publishes the current state (and the Home Assistant discovery config, if enabled) once.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithOpenDB(true, func(db *sql.DB) error {
+			return tools.PublishMQTT(db, true)
+		})
+	},
+}
+
+var mqttListenCmd = &cobra.Command{
+	Use:   "listen",
+	Short: "punch on commands received by MQTT",
+	Long: `Subscribes to <mqtt.topic-prefix>/<mqtt.username>/cmd and executes the commands
+sent there against the clockfile, until stopped with Ctrl-C (or SIGTERM):
+
+in @handle      punch in (also a part of a header instead of the handle)
+switch @handle  switch the running entry to another header
+out             punch out
+
+This lets an NFC tag, a Home Assistant button or a desk switch punch you in.
+Anyone allowed to publish on that topic can punch for you, so protect the broker.
+Commands must not be retained (mosquitto_pub -r, "retain" in Home Assistant):
+retained commands are ignored and removed from the broker.
+
+While listening, "online" is kept in .../availability ("offline" is the last will)
+and the state is published again every mqtt.interval (default 1m).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.ListenMQTT()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(mqttCmd)
+	mqttCmd.AddCommand(mqttListenCmd)
+	mqttCmd.AddCommand(mqttPublishCmd)
+}
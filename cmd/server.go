@@ -1,20 +1,87 @@
 package cmd
 
 import (
+	"database/sql"
+	"fmt"
+
 	"github.com/jramb/p/server"
+	"github.com/jramb/p/tools"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var serverCmd = &cobra.Command{
 	Use:   `server`,
 	Short: `Start the interactive server and wait for connections`,
 	Long: `Start the interactive server and wait for connections.
-	`,
+
+The listen address and TLS certificate can also be configured in the [server] section
+(listen, tls-cert, tls-key). SIGINT or SIGTERM stop the server gracefully.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return server.StartServer(args)
 	},
 }
 
+var tokenScope string
+var tokenOwner string
+
+var serverTokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "manage the API tokens of the server",
+	Long: `Every request to the server needs an API token. Clients send it as
+"Authorization: Bearer <token>", as ?token=<token> or for 'p sync' as timeserver.key.
+The tokens are kept (hashed) in the server database. Authentication can be
+disabled with server.auth = false.`,
+}
+
+var serverTokenAddCmd = &cobra.Command{
+	Use:   "add <name>",
+	Short: "create a new API token",
+	Long:  `Creates a new API token and shows it. Note it down, it can not be shown again.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithServerDB(func(tx *sql.Tx) error {
+			token, err := tools.AddToken(tx, args[0], tokenScope, tokenOwner)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Token %s (%s): %s\n", args[0], tokenScope, token)
+			return nil
+		})
+	},
+}
+
+var serverTokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the API tokens",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithServerDB(tools.ListTokens)
+	},
+}
+
+var serverTokenRevokeCmd = &cobra.Command{
+	Use:   "revoke <name>",
+	Short: "revoke an API token",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithServerDB(func(tx *sql.Tx) error {
+			return tools.RevokeToken(tx, args[0])
+		})
+	},
+}
+
 func init() {
 	RootCmd.AddCommand(serverCmd)
+	serverCmd.AddCommand(serverTokenCmd)
+	serverTokenCmd.AddCommand(serverTokenAddCmd)
+	serverTokenCmd.AddCommand(serverTokenListCmd)
+	serverTokenCmd.AddCommand(serverTokenRevokeCmd)
+	serverTokenAddCmd.Flags().StringVar(&tokenScope, "scope", tools.ScopeRead, "read or write")
+	serverTokenAddCmd.Flags().StringVar(&tokenOwner, "owner", "", "restrict the token to syncing this owner")
+	serverCmd.Flags().String("listen", ":8080", "address to listen on, host:port")
+	serverCmd.Flags().String("tls-cert", "", "TLS certificate file, enables HTTPS")
+	serverCmd.Flags().String("tls-key", "", "TLS key file")
+	viper.BindPFlag("server.listen", serverCmd.Flags().Lookup("listen"))
+	viper.BindPFlag("server.tls-cert", serverCmd.Flags().Lookup("tls-cert"))
+	viper.BindPFlag("server.tls-key", serverCmd.Flags().Lookup("tls-key"))
 }
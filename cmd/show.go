@@ -88,6 +88,20 @@ var showWeekCmd = &cobra.Command{
 	},
 }
 
+var showBillCmd = &cobra.Command{
+	Use:   "bill",
+	Short: "billable time and amounts per client",
+	Long: `Shows the time of the billable headers multiplied with their hourly rate,
+grouped by client. The attributes are set with 'head set', billing.currency is
+the currency of rates without one.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithOpenDB(true, func(db *sql.DB) error {
+			timeFrame := tools.FirstOrEmpty(args)
+			return tools.ShowBilling(db, timeFrame, args)
+		})
+	},
+}
+
 var todayCmd = &cobra.Command{
 	Use:   "now",
 	Short: "show todays time entries",
@@ -105,6 +119,7 @@ func init() {
 	showCmd.AddCommand(showSumCmd)
 	showCmd.AddCommand(showDaysCmd)
 	showCmd.AddCommand(showWeekCmd)
+	showCmd.AddCommand(showBillCmd)
 
 	RootCmd.AddCommand(todayCmd)
 }
@@ -3,91 +3,29 @@
 package cmd
 
 import (
-	"bytes"
 	"database/sql"
-	"errors"
 	"fmt"
-	"net/http"
+	"os"
 
-	"github.com/gorilla/rpc/json"
 	"github.com/jramb/p/tools"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
-type SyncArgs struct {
-	Owner    string              `json:"owner"`
-	Revision int                 `json:"revision"`
-	Key      string              `json:"key"`
-	Headers  *[]tools.JSONHeader `json:"headers"`
-	Entries  *[]tools.JSONEntry  `json:"entries"`
-}
-
-type SyncReply struct {
-	Owner    string             `json:"owner"`
-	Revision int                `json:"revision"`
-	Headers  []tools.JSONHeader `json:"headers"`
-	Entries  []tools.JSONEntry  `json:"entries"`
-}
-
-func contactTimeServer(args SyncArgs) (*SyncReply, error) {
-	rpcURL := viper.GetString("timeserver.rpcurl")
-	if rpcURL == "" {
-		return nil, errors.New("Time server not configured (timeserver.rpcurl)")
-	}
-	message, err := json.EncodeClientRequest("T.Sync", &args)
-	if err != nil {
-		return nil, err
-	}
-
-	req, err := http.NewRequest("POST", rpcURL, bytes.NewBuffer(message))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	client := new(http.Client)
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	var result SyncReply
-	err = json.DecodeClientResponse(resp.Body, &result)
-	if err != nil {
-		return nil, err
-	}
-	return &result, nil
-}
+var syncDryRun bool
 
 func performSync(db *sql.DB, tx *sql.Tx) error {
-	args := SyncArgs{
-		Owner:    viper.GetString("timeserver.owner"),
-		Key:      viper.GetString("timeserver.key"),
-		Revision: tools.GetParamInt(tx, "revision", 0),
-	}
-	args.Headers, args.Entries = tools.GetUncommitted(tx)
-
-	reply, err := contactTimeServer(args)
+	args, reply, err := tools.Sync(tx, 0, syncDryRun)
 	if err != nil {
 		return err
 	}
 
-	if reply.Revision > 0 {
-		if err := tools.ApplyUpdates(tx, reply.Headers, reply.Entries, reply.Revision); err != nil {
-			return err
-		}
-
-		if err := tools.CommitRevision(tx, reply.Revision); err != nil {
-			return err
-		}
-
-		tools.SetParamInt(tx, "revision", reply.Revision)
+	if syncDryRun {
+		fmt.Print("Dry run, nothing changed. ")
 	}
-
-	fmt.Printf("Synced revision %d, push %d/%d, fetched %d/%d\n",
-		reply.Revision, len(*args.Headers), len(*args.Entries),
-		len(reply.Headers), len(reply.Entries))
+	fmt.Printf("Synced revision %d, push %d/%d/%d/%d/%d, fetched %d/%d/%d/%d/%d (headers/entries/logs/todos/deleted)\n",
+		reply.Revision, len(*args.Headers), len(*args.Entries), len(*args.Logs), len(*args.Todos), len(*args.Deleted),
+		len(reply.Headers), len(reply.Entries), len(reply.Logs), len(reply.Todos), len(reply.Deleted))
+	tools.PrintConflicts(reply)
 	return nil
 }
 
@@ -95,12 +33,75 @@ func performSync(db *sql.DB, tx *sql.Tx) error {
 var syncCmd = &cobra.Command{
 	Use:   "sync",
 	Short: "sync with punch time server",
-	Long:  `Currently this is internal/test functionality`,
+	Long: `Sends the local changes to the time server (timeserver.rpcurl) and fetches
+everything new from there. Use 'sync status' to see what would be sent,
+--dry-run contacts the server but neither side stores anything.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if syncDryRun {
+			return tools.WithOpenDB(true, func(db *sql.DB) error {
+				tx, err := db.Begin()
+				if err != nil {
+					return err
+				}
+				defer tx.Rollback()
+				return performSync(db, tx)
+			})
+		}
 		return tools.WithTransaction(performSync)
 	},
 }
 
+var syncStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show the time server setup and the changes not yet synced",
+	Long:  `Shows the configured time server, the last synced revision and the changes the next sync will send.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithOpenDB(true, tools.SyncStatus)
+	},
+}
+
+var syncExportCmd = &cobra.Command{
+	Use:   "export <bundle>",
+	Short: "write a sync bundle for a machine without access to the time server",
+	Long: `Writes all headers, entries, logs, TODOs and deletions to a bundle file.
+Carry it to another machine and read it there with 'sync import'.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithOpenDB(true, func(db *sql.DB) error {
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return tools.ExportBundle(db, f)
+		})
+	},
+}
+
+var syncImportCmd = &cobra.Command{
+	Use:   "import <bundle>",
+	Short: "read a sync bundle written by 'sync export'",
+	Long: `Reads a bundle written by 'sync export' on another machine.
+Records are matched by UUID, when both sides changed a record the later change wins.
+Deletions are applied as well, so exchanging bundles in both directions
+brings two clockfiles to the same state.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tools.WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return tools.ImportBundle(tx, f)
+		})
+	},
+}
+
 func init() {
 	RootCmd.AddCommand(syncCmd)
+	syncCmd.Flags().BoolVarP(&syncDryRun, "dry-run", "n", false, "contact the server, but do not store anything")
+	syncCmd.AddCommand(syncStatusCmd)
+	syncCmd.AddCommand(syncExportCmd)
+	syncCmd.AddCommand(syncImportCmd)
 }
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/jramb/p/tools"
+	"github.com/spf13/viper"
+)
+
+// Every request needs an API token (see 'p server token'), given as
+// "Authorization: Bearer <token>", as ?token=<token> or, for T.Sync,
+// as the key of the sync arguments. Read-only tokens can not change anything.
+// Tokens restricted to an owner only sync that owner, they do not get to the
+// clockfile of the server unless the owner is the server's own timeserver.owner.
+
+type tokenKeyType int
+
+const tokenKey tokenKeyType = 0
+
+// requestToken finds the token of the request, the body is left for the RPC server.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if r.Body == nil {
+		return ""
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, 32<<20))
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var req struct {
+		Params []struct {
+			Key string `json:"key"`
+		} `json:"params"`
+	}
+	if json.Unmarshal(body, &req) != nil || len(req.Params) == 0 {
+		return ""
+	}
+	return req.Params[0].Key
+}
+
+func authenticate(db *sql.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token *tools.APIToken
+		err := tools.WithServerTransaction(db, func(tx *sql.Tx) error {
+			token = tools.FindToken(tx, requestToken(r))
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if token == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey, token)))
+	})
+}
+
+// checkWrite fails for read-only tokens. Without authentication everything is allowed.
+func checkWrite(r *http.Request) error {
+	if token, ok := r.Context().Value(tokenKey).(*tools.APIToken); ok && !token.CanWrite() {
+		return errors.New("Token " + token.Name + " is read-only")
+	}
+	return nil
+}
+
+// checkOwner fails if the token is restricted to another owner.
+func checkOwner(r *http.Request, owner string) error {
+	if token, ok := r.Context().Value(tokenKey).(*tools.APIToken); ok && token.Owner != "" && token.Owner != owner {
+		return errors.New("Token " + token.Name + " is not valid for owner " + owner)
+	}
+	return nil
+}
+
+// checkClockfile fails if the token is restricted to an owner other than the
+// one of the server's clockfile.
+func checkClockfile(r *http.Request) error {
+	if token, ok := r.Context().Value(tokenKey).(*tools.APIToken); ok && token.Owner != "" &&
+		token.Owner != viper.GetString("timeserver.owner") {
+		return errors.New("Token " + token.Name + " is only valid for syncing owner " + token.Owner)
+	}
+	return nil
+}
+
+// clockfileAccess guards handlers serving the clockfile, see checkClockfile.
+func clockfileAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checkClockfile(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jramb/p/tools"
+	"github.com/spf13/viper"
+)
+
+func assert(t *testing.T, assertion bool, expectation string) {
+	if !assertion {
+		t.Error("Failed: " + expectation)
+	}
+}
+
+// testServerDB opens an initialized server database in memory.
+func testServerDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if err := tools.WithServerTransaction(db, tools.PrepareServerDB); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func addToken(t *testing.T, db *sql.DB, name, scope, owner string) string {
+	var token string
+	err := tools.WithServerTransaction(db, func(tx *sql.Tx) (err error) {
+		token, err = tools.AddToken(tx, name, scope, owner)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// authorized runs a request with the token through authenticate and
+// clockfileAccess, handing the authenticated request to fn.
+func authorized(db *sql.DB, token string, fn func(*http.Request)) int {
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	authenticate(db, clockfileAccess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fn(r)
+	}))).ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestTokens(t *testing.T) {
+	viper.Set("timeserver.owner", "me")
+	defer viper.Set("timeserver.owner", "")
+	db := testServerDB(t)
+	reader := addToken(t, db, "reader", tools.ScopeRead, "")
+	own := addToken(t, db, "own", tools.ScopeWrite, "me")
+	other := addToken(t, db, "other", tools.ScopeWrite, "bob")
+
+	tools.WithServerTransaction(db, func(tx *sql.Tx) error {
+		var stored int
+		tx.QueryRow(`select count(*) from api_tokens where token_hash in (?, ?, ?)`, reader, own, other).Scan(&stored)
+		assert(t, stored == 0, "the tokens are not stored in clear")
+		_, err := tools.AddToken(tx, "reader", tools.ScopeRead, "")
+		assert(t, err != nil, "token names are unique")
+		return nil
+	})
+
+	ok := func(*http.Request) {}
+	assert(t, authorized(db, "", ok) == http.StatusUnauthorized, "a token is required")
+	assert(t, authorized(db, "nonsense", ok) == http.StatusUnauthorized, "an unknown token is refused")
+	assert(t, authorized(db, other, ok) == http.StatusForbidden, "another owner's token does not get the clockfile")
+	assert(t, authorized(db, own, ok) == http.StatusOK, "the server owner's token gets the clockfile")
+
+	p := &PunchService{}
+	authorized(db, reader, func(r *http.Request) {
+		assert(t, checkWrite(r) != nil, "a read-only token can not write")
+		assert(t, p.Out(r, &PunchArgs{}, &RunningReply{}) != nil, "a read-only token can not punch out")
+		assert(t, checkOwner(r, "bob") == nil, "an unrestricted token syncs every owner")
+		err := p.Show(r, &ShowArgs{TimeFrame: "week-x"}, &ShowReply{})
+		assert(t, err != nil && !strings.Contains(err.Error(), "clockfile"), "a bad time frame is an error")
+	})
+	r := httptest.NewRequest("POST", "/rpc", nil)
+	tools.WithServerTransaction(db, func(tx *sql.Tx) error {
+		r = r.WithContext(context.WithValue(r.Context(), tokenKey, tools.FindToken(tx, other)))
+		return nil
+	})
+	assert(t, checkWrite(r) == nil, "a write token can write")
+	assert(t, checkOwner(r, "bob") == nil, "a restricted token syncs its owner")
+	assert(t, checkOwner(r, "me") != nil, "a restricted token does not sync another owner")
+	refused := func(err error) bool { return err != nil && strings.Contains(err.Error(), "only valid for syncing") }
+	assert(t, refused(p.In(r, &PunchArgs{Handle: "x"}, &RunningReply{})), "a restricted token can not punch in")
+	assert(t, refused(p.Running(r, &RunningArgs{}, &RunningReply{})), "a restricted token can not read the clockfile")
+	assert(t, refused(p.Show(r, &ShowArgs{TimeFrame: "week"}, &ShowReply{})), "a restricted token can not show the times")
+	sync := &TimeService{db: db}
+	err := sync.Sync(r, &tools.SyncArgs{Owner: "me"}, &tools.SyncReply{})
+	assert(t, err != nil, "a restricted token can not sync another owner")
+	err = sync.Sync(r, &tools.SyncArgs{Owner: "bob"}, &tools.SyncReply{})
+	assert(t, err == nil, "a restricted token syncs its owner")
+}
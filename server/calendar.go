@@ -0,0 +1,36 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"log"
+	"net/http"
+
+	"github.com/jramb/p/tools"
+)
+
+// serveCalendar serves the time entries as an iCalendar feed, the time frame
+// (default month) and filter are taken from the query string, e.g.
+// /calendar.ics?timeframe=month-1&filter=customer
+func serveCalendar(w http.ResponseWriter, r *http.Request) {
+	timeFrame := r.URL.Query().Get("timeframe")
+	if timeFrame == "" {
+		timeFrame = "month"
+	}
+	from, to, err := tools.DecodeTimeFrame(timeFrame)
+	if err != nil {
+		http.Error(w, "Invalid time frame: "+timeFrame, http.StatusBadRequest)
+		return
+	}
+	var cal bytes.Buffer
+	err = withClockfile(func(db *sql.DB, tx *sql.Tx) error {
+		return tools.ExportICS(db, &cal, from, to, r.URL.Query().Get("filter"))
+	})
+	if err != nil {
+		log.Printf("msg=\"calendar failed\" error=%q", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write(cal.Bytes())
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The dashboard is a single page using the P methods on /rpc,
+// so it needs no access rights of its own.
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jramb/p/tools"
+)
+
+// The event stream on /events (Server-Sent Events) tells about punching,
+// new TODOs and logs and synced entries. Changes of the clockfile are found
+// by comparing it to the last known state: right after the P methods and
+// regularly for changes done with the command line.
+
+type Event struct {
+	Type   string     `json:"type"` // start, stop, switch, todo, log or sync
+	Header string     `json:"header,omitempty"`
+	Handle string     `json:"handle,omitempty"`
+	Start  *time.Time `json:"start,omitempty"`
+	Text   string     `json:"text,omitempty"`  // of the TODO or log
+	Owner  string     `json:"owner,omitempty"` // of the synced entry
+}
+
+type broker struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]bool
+	done        chan struct{}
+
+	checkMu  sync.Mutex // guards the fields below
+	checked  bool
+	failing  bool
+	running  map[tools.RowId]tools.RunningEntry
+	lastTodo int
+	lastLog  int64
+}
+
+func newBroker() *broker {
+	return &broker{
+		subscribers: make(map[chan Event]bool),
+		done:        make(chan struct{}),
+	}
+}
+
+func (b *broker) subscribe() chan Event {
+	c := make(chan Event, 16)
+	b.mu.Lock()
+	b.subscribers[c] = true
+	b.mu.Unlock()
+	return c
+}
+
+func (b *broker) unsubscribe(c chan Event) {
+	b.mu.Lock()
+	delete(b.subscribers, c)
+	b.mu.Unlock()
+}
+
+// publish never blocks, a subscriber too slow to keep up misses the event.
+func (b *broker) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.subscribers {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// close ends the poller and all event streams.
+func (b *broker) close() {
+	close(b.done)
+}
+
+// check compares the clockfile with the last known state and publishes the differences.
+func (b *broker) check() {
+	b.checkMu.Lock()
+	defer b.checkMu.Unlock()
+	var running []tools.RunningEntry
+	var todos []tools.TodoItem
+	var logs []tools.LogItem
+	var lastLog int64
+	err := withClockfile(func(db *sql.DB, tx *sql.Tx) error {
+		running = tools.RunningEntries(tx, time.Now())
+		todos = tools.NewTodos(tx, b.lastTodo)
+		logs, lastLog = tools.NewLogs(tx, b.lastLog)
+		return nil
+	})
+	if err != nil {
+		if !b.failing {
+			log.Printf("msg=\"event check failed\" error=%q", err.Error())
+		}
+		b.failing = true
+		return
+	}
+	b.failing = false
+	now := make(map[tools.RowId]tools.RunningEntry)
+	for _, r := range running {
+		now[r.Id] = r
+	}
+	if b.checked {
+		switched := false
+		for id, r := range now {
+			start := r.Start
+			if old, ok := b.running[id]; !ok {
+				b.publish(Event{Type: "start", Header: r.Header, Handle: r.Handle, Start: &start})
+				switched = true
+			} else if old.Header != r.Header || old.Handle != r.Handle {
+				b.publish(Event{Type: "switch", Header: r.Header, Handle: r.Handle, Start: &start})
+				switched = true
+			}
+		}
+		for id, r := range b.running {
+			if _, ok := now[id]; !ok {
+				start := r.Start
+				b.publish(Event{Type: "stop", Header: r.Header, Handle: r.Handle, Start: &start})
+				switched = true
+			}
+		}
+		if switched {
+			go publishMQTT()
+		}
+		for _, t := range todos {
+			created := t.CreationDate
+			b.publish(Event{Type: "todo", Handle: t.Handle, Text: t.Title, Start: &created})
+		}
+		for _, l := range logs {
+			created := l.CreationDate
+			b.publish(Event{Type: "log", Handle: l.Handle, Text: l.Text, Start: &created})
+		}
+	}
+	for _, t := range todos {
+		if t.Id > b.lastTodo {
+			b.lastTodo = t.Id
+		}
+	}
+	b.lastLog = lastLog
+	b.running = now
+	b.checked = true
+}
+
+// publishMQTT updates the retained MQTT state after remote punching.
+func publishMQTT() {
+	err := tools.WithOpenDB(true, func(db *sql.DB) error {
+		return tools.PublishMQTT(db, false)
+	})
+	if err != nil {
+		log.Printf("msg=\"mqtt publish failed\" error=%q", err.Error())
+	}
+}
+
+// poll checks the clockfile regularly, until the broker is closed.
+func (b *broker) poll(interval time.Duration) {
+	b.check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.check()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	c := b.subscribe()
+	defer b.unsubscribe(c)
+	fmt.Fprint(w, ": punch events\n\n")
+	flusher.Flush()
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-c:
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-b.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/rpc"
+)
+
+// Every request is logged as one line of key=value pairs,
+// RPC requests also with the called method and its error.
+
+type requestLog struct {
+	rpcMethod string
+	rpcError  error
+}
+
+type logKeyType int
+
+const logKey logKeyType = 0
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestLog{}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), logKey, info)))
+		line := fmt.Sprintf("method=%s path=%s status=%d duration=%s remote=%s",
+			r.Method, r.URL.Path, sw.status, time.Since(start).Round(time.Microsecond), r.RemoteAddr)
+		if info.rpcMethod != "" {
+			line += " rpc=" + info.rpcMethod
+		}
+		if info.rpcError != nil {
+			line += fmt.Sprintf(" error=%q", info.rpcError.Error())
+		}
+		log.Println(line)
+	})
+}
+
+// logRPC is called by the RPC server after each method.
+func logRPC(i *rpc.RequestInfo) {
+	if info, ok := i.Request.Context().Value(logKey).(*requestLog); ok {
+		info.rpcMethod = i.Method
+		info.rpcError = i.Error
+	}
+}
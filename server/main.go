@@ -1,25 +1,90 @@
 package server
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/rpc"
 	"github.com/gorilla/rpc/json"
+	"github.com/jramb/p/tools"
+	"github.com/spf13/viper"
 )
 
-type PunchService struct{}
+type PunchService struct {
+	events *broker
+}
 
+// StartServer serves until SIGINT or SIGTERM, then waits for the running
+// requests to finish and closes the server database.
 func StartServer(args []string) error {
-	fmt.Println("Server:", args)
-
+	events := newBroker()
 	s := rpc.NewServer()
 	s.RegisterCodec(json.NewCodec(), "application/json")
-	s.RegisterService(new(PunchService), "P")
-	http.Handle("/rpc", s)
+	s.RegisterService(&PunchService{events: events}, "P")
+	s.RegisterAfterFunc(logRPC)
+	protect := func(h http.Handler) http.Handler { return h }
+	auth := !viper.IsSet("server.auth") || viper.GetBool("server.auth")
+	var serverDB *sql.DB
+	if db, err := tools.OpenServerDB(); err == nil {
+		defer db.Close()
+		if err := tools.WithServerTransaction(db, tools.PrepareServerDB); err != nil {
+			return err
+		}
+		serverDB = db
+		s.RegisterService(&TimeService{db: db, events: events}, "T")
+		if auth {
+			protect = func(h http.Handler) http.Handler { return authenticate(db, h) }
+		}
+	} else if auth {
+		return fmt.Errorf("%s, the API tokens are kept there (or set server.auth = false)", err)
+	} else {
+		log.Println("msg=\"sync disabled\" reason=" + err.Error())
+	}
+	if !auth {
+		log.Println("msg=\"authentication disabled\"")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", protect(s))
+	mux.Handle("/events", protect(clockfileAccess(events)))
+	mux.Handle("/metrics", protect(clockfileAccess(serveMetrics(serverDB))))
+	mux.Handle("/calendar.ics", protect(clockfileAccess(http.HandlerFunc(serveCalendar))))
+	mux.HandleFunc("/", serveDashboard)
+
+	listen := viper.GetString("server.listen")
+	certFile := viper.GetString("server.tls-cert")
+	keyFile := viper.GetString("server.tls-key")
+	srv := &http.Server{Addr: listen, Handler: logRequests(mux)}
+	srv.RegisterOnShutdown(events.close)
+	go events.poll(5 * time.Second)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	failed := make(chan error, 1)
+	go func() {
+		var err error
+		if certFile != "" || keyFile != "" {
+			err = srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		failed <- err
+	}()
+	log.Printf("msg=listening addr=%s tls=%t", listen, certFile != "" || keyFile != "")
 
-	fmt.Println("I am listening!")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-	return nil
+	select {
+	case err := <-failed:
+		return err
+	case sig := <-stop:
+		log.Printf("msg=\"shutting down\" signal=%s", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}
 }
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jramb/p/tools"
+)
+
+// /metrics shows the clockfile in the Prometheus text format, so it can be
+// scraped and graphed without an extra exporter. The tracked seconds are
+// those of 'p show', plus the part of the running entries.
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (m *metricsWriter) describe(name, help string) {
+	fmt.Fprintf(m, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+// sample writes one value, labels are given as name, value pairs.
+func (m *metricsWriter) sample(name string, value interface{}, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(m, "%s %v\n", name, value)
+}
+
+type headerKey struct {
+	header, handle string
+}
+
+// trackedSeconds sums up the time per header from 'from' until now.
+func trackedSeconds(db *sql.DB, from time.Time, running []tools.RunningEntry, now time.Time) (map[headerKey]int64, error) {
+	days, err := tools.QueryDays(db, from, now, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	seconds := make(map[headerKey]int64)
+	for _, d := range days {
+		seconds[headerKey{d.Head, d.Handle}] += d.Duration
+	}
+	for _, r := range running {
+		start := r.Start
+		if start.Before(from) {
+			start = from
+		}
+		if now.After(start) {
+			seconds[headerKey{r.Header, r.Handle}] += int64(now.Sub(start) / time.Second)
+		}
+	}
+	return seconds, nil
+}
+
+func sortedKeys(m map[headerKey]int64) []headerKey {
+	keys := make([]headerKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].header != keys[j].header {
+			return keys[i].header < keys[j].header
+		}
+		return keys[i].handle < keys[j].handle
+	})
+	return keys
+}
+
+// serveMetrics returns the /metrics handler, serverDB is nil without sync.
+func serveMetrics(serverDB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var m metricsWriter
+		err := withClockfile(func(db *sql.DB, tx *sql.Tx) error {
+			now := time.Now()
+			running := tools.RunningEntries(tx, now)
+			m.describe("punch_running", "1 if the header is punched in, else 0.")
+			isRunning := make(map[headerKey]bool)
+			for _, r := range running {
+				isRunning[headerKey{r.Header, r.Handle}] = true
+			}
+			for _, h := range tools.QueryHeaders(tx, "") {
+				value := 0
+				if isRunning[headerKey{h.Header, h.Handle}] {
+					value = 1
+				}
+				m.sample("punch_running", value, "header", h.Header, "handle", h.Handle)
+			}
+
+			m.describe("punch_tracked_seconds", "Seconds tracked per header today and this week, including running entries.")
+			for _, period := range []string{"today", "week"} {
+				from, _, err := tools.DecodeTimeFrame(period)
+				if err != nil {
+					return err
+				}
+				seconds, err := trackedSeconds(db, from, running, now)
+				if err != nil {
+					return err
+				}
+				for _, k := range sortedKeys(seconds) {
+					m.sample("punch_tracked_seconds", seconds[k], "header", k.header, "handle", k.handle, "period", period)
+				}
+			}
+
+			m.describe("punch_todos_open", "Number of open TODOs per handle.")
+			open := make(map[string]int)
+			for _, t := range tools.QueryTodos(tx, "") {
+				open[t.Handle]++
+			}
+			handles := make([]string, 0, len(open))
+			for handle := range open {
+				handles = append(handles, handle)
+			}
+			sort.Strings(handles)
+			for _, handle := range handles {
+				m.sample("punch_todos_open", open[handle], "handle", handle)
+			}
+
+			m.describe("punch_sync_revision", "Time server revision the clockfile was last synced with.")
+			m.sample("punch_sync_revision", tools.GetParamInt(tx, "revision", 0))
+			return nil
+		})
+		if err == nil && serverDB != nil {
+			err = tools.WithServerTransaction(serverDB, func(tx *sql.Tx) error {
+				revisions := tools.ServerRevisions(tx)
+				owners := make([]string, 0, len(revisions))
+				for owner := range revisions {
+					owners = append(owners, owner)
+				}
+				sort.Strings(owners)
+				m.describe("punch_server_revision", "Current revision on this time server per owner.")
+				for _, owner := range owners {
+					m.sample("punch_server_revision", revisions[owner], "owner", owner)
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			log.Printf("msg=\"metrics failed\" error=%q", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(m.Bytes())
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jramb/p/tools"
+)
+
+// Remote punching, e.g. from a phone. The methods do the same as the
+// corresponding commands and return the resulting state.
+
+type PunchArgs struct {
+	Handle string // with or without @
+	Header string // part of the header, if there is no handle
+	Modify string // like -m: 10m punches 10 minutes earlier
+}
+
+type RunningArgs struct{}
+
+type RunningReply struct {
+	Running []tools.RunningEntry
+}
+
+type HeadersArgs struct {
+	Filter string
+	Recent int // only the most recently used headers
+}
+
+type HeadersReply struct {
+	Headers []tools.HeaderInfo
+}
+
+type TodoArgs struct {
+	Handle string // default is the running header
+	Add    string // a new TODO
+	Done   []int  // TODO numbers to mark as done
+}
+
+type TodoReply struct {
+	Todos []tools.TodoItem
+}
+
+type LogArgs struct {
+	Text      string // added if not empty
+	TimeFrame string // of the logs to return, default today
+}
+
+type LogReply struct {
+	Logs []tools.LogItem
+}
+
+// withClockfile runs fn in a transaction on the clockfile. Other than
+// tools.WithTransaction a panic rolls back and is returned as an error.
+func withClockfile(fn func(*sql.DB, *sql.Tx) error) error {
+	return tools.WithOpenDB(true, func(db *sql.DB) error {
+		return tools.WithServerTransaction(db, func(tx *sql.Tx) error {
+			return fn(db, tx)
+		})
+	})
+}
+
+// changed lets the event stream know about a successful change.
+func (h *PunchService) changed(err error) error {
+	if err == nil && h.events != nil {
+		h.events.check()
+	}
+	return err
+}
+
+func effectiveTime(modify string) (time.Time, error) {
+	effectiveTimeNow := time.Now()
+	if modify != "" {
+		m, err := time.ParseDuration(modify)
+		if err != nil {
+			return effectiveTimeNow, err
+		}
+		effectiveTimeNow = effectiveTimeNow.Add(-m)
+	}
+	return effectiveTimeNow.Round(time.Minute), nil
+}
+
+// headerArgs returns the handle and header arguments as CheckIn expects them.
+func headerArgs(db *sql.DB, args *PunchArgs) (string, []string, error) {
+	handle := strings.TrimPrefix(args.Handle, "@")
+	if handle != "" {
+		_, err := tools.VerifyHandle(db, handle, false)
+		return handle, nil, err
+	}
+	if args.Header == "" {
+		return "", nil, errors.New("Need a handle or header")
+	}
+	return "", []string{args.Header}, nil
+}
+
+func (h *PunchService) In(r *http.Request, args *PunchArgs, reply *RunningReply) error {
+	if err := checkClockfile(r); err != nil {
+		return err
+	}
+	if err := checkWrite(r); err != nil {
+		return err
+	}
+	return h.changed(withClockfile(func(db *sql.DB, tx *sql.Tx) error {
+		effectiveTimeNow, err := effectiveTime(args.Modify)
+		if err != nil {
+			return err
+		}
+		handle, argv, err := headerArgs(db, args)
+		if err != nil {
+			return err
+		}
+		if err := tools.CloseAll(tx, effectiveTimeNow); err != nil {
+			return err
+		}
+		if err := tools.CheckIn(tx, argv, handle, effectiveTimeNow); err != nil {
+			return err
+		}
+		reply.Running = tools.RunningEntries(tx, effectiveTimeNow)
+		return nil
+	}))
+}
+
+func (h *PunchService) Out(r *http.Request, args *PunchArgs, reply *RunningReply) error {
+	if err := checkClockfile(r); err != nil {
+		return err
+	}
+	if err := checkWrite(r); err != nil {
+		return err
+	}
+	return h.changed(withClockfile(func(db *sql.DB, tx *sql.Tx) error {
+		effectiveTimeNow, err := effectiveTime(args.Modify)
+		if err != nil {
+			return err
+		}
+		if err := tools.CloseAll(tx, effectiveTimeNow); err != nil {
+			return err
+		}
+		reply.Running = tools.RunningEntries(tx, effectiveTimeNow)
+		return nil
+	}))
+}
+
+func (h *PunchService) Switch(r *http.Request, args *PunchArgs, reply *RunningReply) error {
+	if err := checkClockfile(r); err != nil {
+		return err
+	}
+	if err := checkWrite(r); err != nil {
+		return err
+	}
+	return h.changed(withClockfile(func(db *sql.DB, tx *sql.Tx) error {
+		handle, argv, err := headerArgs(db, args)
+		if err != nil {
+			return err
+		}
+		effectiveTimeNow := time.Now()
+		if err := tools.ChangeCheckIn(tx, argv, handle, effectiveTimeNow); err != nil {
+			return err
+		}
+		reply.Running = tools.RunningEntries(tx, effectiveTimeNow)
+		return nil
+	}))
+}
+
+func (h *PunchService) Running(r *http.Request, args *RunningArgs, reply *RunningReply) error {
+	if err := checkClockfile(r); err != nil {
+		return err
+	}
+	return withClockfile(func(db *sql.DB, tx *sql.Tx) error {
+		reply.Running = tools.RunningEntries(tx, time.Now())
+		return nil
+	})
+}
+
+func (h *PunchService) Headers(r *http.Request, args *HeadersArgs, reply *HeadersReply) error {
+	if err := checkClockfile(r); err != nil {
+		return err
+	}
+	return withClockfile(func(db *sql.DB, tx *sql.Tx) error {
+		if args.Recent > 0 {
+			reply.Headers = tools.RecentHeaders(tx, args.Recent)
+		} else {
+			reply.Headers = tools.QueryHeaders(tx, args.Filter)
+		}
+		return nil
+	})
+}
+
+func (h *PunchService) Todo(r *http.Request, args *TodoArgs, reply *TodoReply) error {
+	if err := checkClockfile(r); err != nil {
+		return err
+	}
+	if args.Add != "" || len(args.Done) > 0 {
+		if err := checkWrite(r); err != nil {
+			return err
+		}
+	}
+	return h.changed(withClockfile(func(db *sql.DB, tx *sql.Tx) error {
+		handle, err := tools.VerifyHandle(db, strings.TrimPrefix(args.Handle, "@"), true)
+		if err != nil {
+			return err
+		}
+		effectiveTimeNow := time.Now()
+		if args.Add != "" {
+			if handle == "" {
+				return errors.New("TODOs need a handle (nothing is running)")
+			}
+			if err := tools.AddTodo(tx, args.Add, handle, effectiveTimeNow); err != nil {
+				return err
+			}
+		}
+		if len(args.Done) > 0 {
+			done := make([]string, len(args.Done))
+			for i, nn := range args.Done {
+				done[i] = strconv.Itoa(nn)
+			}
+			if err := tools.TodoDone(tx, done, handle, effectiveTimeNow); err != nil {
+				return err
+			}
+		}
+		reply.Todos = tools.QueryTodos(tx, handle)
+		return nil
+	}))
+}
+
+func (h *PunchService) Log(r *http.Request, args *LogArgs, reply *LogReply) error {
+	if err := checkClockfile(r); err != nil {
+		return err
+	}
+	if args.Text != "" {
+		if err := checkWrite(r); err != nil {
+			return err
+		}
+	}
+	return h.changed(withClockfile(func(db *sql.DB, tx *sql.Tx) error {
+		timeFrame := args.TimeFrame
+		if timeFrame == "" {
+			timeFrame = "today"
+		}
+		from, to, err := tools.DecodeTimeFrame(timeFrame)
+		if err != nil {
+			return err
+		}
+		if args.Text != "" {
+			if err := tools.LogEntry(tx, []string{args.Text}, time.Now()); err != nil {
+				return err
+			}
+		}
+		reply.Logs = tools.QueryLogs(tx, from, to)
+		return nil
+	}))
+}
@@ -20,15 +20,16 @@ type ShowReply struct {
 }
 
 func (h *PunchService) Show(r *http.Request, args *ShowArgs, reply *ShowReply) error {
+	if err := checkClockfile(r); err != nil {
+		return err
+	}
+	var err error
+	if reply.From, reply.To, err = tools.DecodeTimeFrame(args.TimeFrame); err != nil {
+		return err
+	}
 	error := tools.WithOpenDB(true, func(db *sql.DB) error {
 		rounding, bias := tools.GetRoundingAndBias()
-		timeFrame := args.TimeFrame
 		filter := args.Filter
-		var err error
-		reply.From, reply.To, err = tools.DecodeTimeFrame(timeFrame)
-		if err != nil {
-			panic(err)
-		}
 		if timeEntries, err := tools.QueryDays(db, reply.From, reply.To, filter, rounding, bias); err == nil {
 			reply.TimeDurationEntries = timeEntries
 		} else {
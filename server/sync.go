@@ -0,0 +1,47 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/jramb/p/tools"
+)
+
+// TimeService is the time server counterpart of 'p sync'
+type TimeService struct {
+	db     *sql.DB
+	events *broker
+}
+
+func (t *TimeService) Sync(r *http.Request, args *tools.SyncArgs, reply *tools.SyncReply) error {
+	if err := checkOwner(r, args.Owner); err != nil {
+		return err
+	}
+	if args.Pushes() {
+		if err := checkWrite(r); err != nil {
+			return err
+		}
+	}
+	var synced []Event
+	err := tools.WithServerTransaction(t.db, func(tx *sql.Tx) error {
+		if err := tools.ServerSync(tx, args, reply); err != nil {
+			return err
+		}
+		if args.DryRun {
+			return tools.ErrDryRun
+		}
+		if args.Entries != nil {
+			for _, e := range *args.Entries {
+				header, handle := tools.SyncedHeader(tx, args.Owner, e.HeaderUUID)
+				synced = append(synced, Event{Type: "sync", Owner: args.Owner, Header: header, Handle: handle, Start: e.Start})
+			}
+		}
+		return nil
+	})
+	if err == nil && t.events != nil {
+		for _, e := range synced {
+			t.events.publish(e)
+		}
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package tools
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// The billing report multiplies the time of the billable headers with their
+// hourly rate, grouped by client. Sub-headers inherit the client, billable
+// flag, rate and currency of their parents unless they have their own.
+
+type billedHeader struct {
+	path   string
+	handle string
+	dur    time.Duration
+	attrs  headerAttrs
+}
+
+// effectiveAttrs returns the attributes of every header, the unset ones
+// filled in from the parents.
+func effectiveAttrs(db *sql.DB) map[RowId]headerAttrs {
+	type node struct {
+		id     RowId
+		parent string
+		attrs  headerAttrs
+	}
+	byUUID := make(map[string]*node)
+	rows := dbQ(db.Query, `select header_id, coalesce(header_uuid,''), coalesce(parent_uuid,''),
+	coalesce(client,''), billable, coalesce(rate,0), coalesce(currency,''), coalesce(budget,0) from headers`)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	nodes := make([]*node, 0)
+	for rows.Next() {
+		n := &node{}
+		var uuid string
+		var budget int64
+		rows.Scan(&n.id, &uuid, &n.parent, &n.attrs.client, &n.attrs.billable, &n.attrs.rate, &n.attrs.currency, &budget)
+		n.attrs.budget = time.Duration(budget) * time.Second
+		byUUID[uuid] = n
+		nodes = append(nodes, n)
+	}
+	result := make(map[RowId]headerAttrs, len(nodes))
+	for _, n := range nodes {
+		a := n.attrs
+		for p, depth := byUUID[n.parent], 0; p != nil && depth < 20; p, depth = byUUID[p.parent], depth+1 {
+			a = a.inherit(p.attrs)
+		}
+		result[n.id] = a
+	}
+	return result
+}
+
+func ShowBilling(db *sql.DB, timeFrame string, argv []string) error {
+	rounding, bias := GetRoundingAndBias()
+	from, to, err := DecodeTimeFrame(timeFrame)
+	if err != nil {
+		return err
+	}
+	var filter string
+	if len(argv) > 1 {
+		filter = argv[1]
+	}
+	attrs := effectiveAttrs(db)
+	rows := dbQ(db.Query, `
+select h.header_id, coalesce(t.path, h.header) path, coalesce(h.handle,''),
+  sum(strftime('%s',coalesce(e.end,current_timestamp))-strftime('%s',e.start)) sum_duration
+from entries e
+join headers h on h.header_id = e.header_id and h.active=1
+left join header_tree t on t.header_id = h.header_id
+where e.start between ? and ?
+and lower(coalesce(t.path, h.header)) like lower('%'||?||'%')
+group by h.header_id, path, h.handle
+order by path
+`, from, to, filter)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	clients := make(map[string][]billedHeader)
+	notBillable := time.Duration(0)
+	for rows.Next() {
+		var id RowId
+		var b billedHeader
+		var duration int64
+		rows.Scan(&id, &b.path, &b.handle, &duration)
+		b.dur = DurationRound(time.Duration(duration*1000000000), rounding, bias)
+		b.attrs = attrs[id]
+		if b.attrs.billable == nil || !*b.attrs.billable {
+			notBillable += b.dur
+			continue
+		}
+		clients[b.attrs.client] = append(clients[b.attrs.client], b)
+	}
+
+	names := make([]string, 0, len(clients))
+	for client := range clients {
+		names = append(names, client)
+	}
+	sort.Strings(names)
+	defaultCurrency := viper.GetString("billing.currency")
+	totals := make(map[string]float64)
+	fmt.Println("Billing:", printTimeFrame(&from, &to))
+	for _, client := range names {
+		if client == "" {
+			fmt.Println("(no client)")
+		} else {
+			fmt.Println(client)
+		}
+		sums := make(map[string]float64)
+		for _, b := range clients[client] {
+			currency := b.attrs.currency
+			if currency == "" {
+				currency = defaultCurrency
+			}
+			amount := b.dur.Hours() * b.attrs.rate
+			rate := "no rate"
+			if b.attrs.rate != 0 {
+				rate = fmt.Sprintf("%.2f/h", b.attrs.rate)
+			}
+			fmt.Printf("%12s  %10s %12.2f %-3s  %s\n", formatDuration(b.dur), rate, amount, currency, formatHeader(b.path, b.handle))
+			sums[currency] += amount
+			totals[currency] += amount
+		}
+		if len(clients[client]) > 1 || len(sums) > 1 {
+			for _, currency := range sortedCurrencies(sums) {
+				fmt.Printf("%25s %12.2f %-3s\n", "", sums[currency], currency)
+			}
+		}
+	}
+	for _, currency := range sortedCurrencies(totals) {
+		fmt.Printf("     Total: %25.2f %-3s\n", totals[currency], currency)
+	}
+	if notBillable != 0 {
+		fmt.Printf("Not billable: %10s\n", formatDuration(notBillable))
+	}
+	return nil
+}
+
+func sortedCurrencies(amounts map[string]float64) []string {
+	currencies := make([]string, 0, len(amounts))
+	for c := range amounts {
+		currencies = append(currencies, c)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
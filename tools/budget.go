@@ -0,0 +1,182 @@
+package tools
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jramb/p/table"
+	"github.com/spf13/viper"
+)
+
+// A budget is the time planned for a header, its sub-headers included. The
+// used time is rounded per header like in ShowTimes, the burn rate of the last
+// budget.burn-days (default 28) projects the day the budget runs out.
+
+type budgetStatus struct {
+	id      RowId
+	path    string
+	handle  string
+	budget  time.Duration
+	used    time.Duration
+	recent  time.Duration // used during the burn window
+	members map[RowId]bool
+}
+
+func (b budgetStatus) percent() float64 {
+	return 100 * float64(b.used) / float64(b.budget)
+}
+
+// exhaustion projects when the budget is used up at the recent burn rate,
+// ok is false if nothing was used recently.
+func (b budgetStatus) exhaustion(now time.Time, window time.Duration) (day time.Time, ok bool) {
+	remaining := b.budget - b.used
+	if remaining <= 0 {
+		return now, true
+	}
+	if b.recent <= 0 {
+		return now, false
+	}
+	return now.Add(time.Duration(float64(remaining) / float64(b.recent) * float64(window))), true
+}
+
+func burnWindow() time.Duration {
+	days := 28
+	if viper.IsSet("budget.burn-days") {
+		days = viper.GetInt("budget.burn-days")
+	}
+	if days < 1 {
+		days = 1
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// queryBudgets returns the status of every header with a budget.
+func queryBudgets(query func(string, ...interface{}) (*sql.Rows, error), now time.Time) []*budgetStatus {
+	rounding, bias := GetRoundingAndBias()
+	budgets := make([]*budgetStatus, 0)
+	byID := make(map[RowId]*budgetStatus)
+	rh := dbQ(query, `select h.header_id, coalesce(t.path, h.header), coalesce(h.handle,''), h.budget
+	from headers h
+	left join header_tree t on t.header_id = h.header_id
+	where h.budget is not null and h.active = 1
+	order by coalesce(t.path, h.header)`)
+	defer rh.Close()
+	defer checkDBErr(rh)
+	for rh.Next() {
+		b := &budgetStatus{members: make(map[RowId]bool)}
+		var seconds int64
+		rh.Scan(&b.id, &b.path, &b.handle, &seconds)
+		b.budget = time.Duration(seconds) * time.Second
+		budgets = append(budgets, b)
+		byID[b.id] = b
+	}
+	// every header with a budget and its sub-headers, with their time
+	rs := dbQ(query, `with recursive sub (budget_id, header_id, header_uuid, depth) as
+	( select header_id, header_id, header_uuid, 0 from headers where budget is not null and active = 1
+	  union all
+	  select sub.budget_id, h.header_id, h.header_uuid, sub.depth+1
+	  from headers h join sub on h.parent_uuid = sub.header_uuid
+	  where sub.depth < 20
+	)
+	select sub.budget_id, sub.header_id,
+	  coalesce(sum(strftime('%s',coalesce(e.end,current_timestamp))-strftime('%s',e.start)),0),
+	  coalesce(sum(case when e.start >= ? then strftime('%s',coalesce(e.end,current_timestamp))-strftime('%s',e.start) end),0)
+	from sub
+	left join entries e on e.header_id = sub.header_id
+	group by sub.budget_id, sub.header_id`, now.Add(-burnWindow()))
+	defer rs.Close()
+	defer checkDBErr(rs)
+	for rs.Next() {
+		var budgetID, headerID RowId
+		var used, recent int64
+		rs.Scan(&budgetID, &headerID, &used, &recent)
+		b, ok := byID[budgetID]
+		if !ok {
+			continue
+		}
+		b.members[headerID] = true
+		b.used += DurationRound(time.Duration(used)*time.Second, rounding, bias)
+		b.recent += DurationRound(time.Duration(recent)*time.Second, rounding, bias)
+	}
+	return budgets
+}
+
+// ShowBudgets lists the budgets, or the ones covering the header ref.
+func ShowBudgets(db *sql.DB, ref string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var only *headerRef
+	if ref != "" {
+		h, err := findHeaderRef(tx, ref)
+		if err != nil {
+			return err
+		}
+		only = &h
+	}
+	now := time.Now()
+	window := burnWindow()
+	tab := table.NewTable()
+	row := table.NewRow()
+	for _, title := range []string{"Header", "Budget", "Used", "%", "Left", "Per week", "Runs out"} {
+		row = row.Add(table.Cell{title, table.Center})
+	}
+	tab = tab.Add(row)
+	tab = tab.AddDivider()
+	found := false
+	for _, b := range queryBudgets(tx.Query, now) {
+		if only != nil && !b.members[only.id] {
+			continue
+		}
+		found = true
+		runsOut := "-"
+		if day, ok := b.exhaustion(now, window); ok {
+			if b.used >= b.budget {
+				runsOut = "exceeded"
+			} else {
+				runsOut = day.Format(simpleDateFormat)
+			}
+		}
+		row = table.NewRow()
+		row = row.Add(table.Cell{formatHeader(b.path, b.handle), table.Left})
+		row = row.Add(table.Cell{formatDuration(b.budget), table.Right})
+		row = row.Add(table.Cell{formatDuration(b.used), table.Right})
+		row = row.Add(table.Cell{fmt.Sprintf("%.0f%%", b.percent()), table.Right})
+		row = row.Add(table.Cell{formatDuration(b.budget - b.used), table.Right})
+		row = row.Add(table.Cell{formatDuration(time.Duration(float64(b.recent) * float64(7*24*time.Hour) / float64(window))), table.Right})
+		row = row.Add(table.Cell{runsOut, table.Left})
+		tab = tab.Add(row)
+	}
+	if !found {
+		if only != nil {
+			fmt.Printf("%s has no budget, see 'budget set'\n", *only)
+		} else {
+			fmt.Println("No budgets, see 'budget set'")
+		}
+		return nil
+	}
+	tab.Print(viper.GetBool("show.orgmode"))
+	return nil
+}
+
+// warnBudget tells when the header (or one of its parents) has used more than
+// budget.warn-threshold percent (default 90) of its budget, 0 turns it off.
+func warnBudget(tx *sql.Tx, hdr RowId) {
+	threshold := 90.0
+	if viper.IsSet("budget.warn-threshold") {
+		threshold = viper.GetFloat64("budget.warn-threshold")
+	}
+	if threshold <= 0 {
+		return
+	}
+	for _, b := range queryBudgets(tx.Query, time.Now()) {
+		if b.members[hdr] && b.percent() >= threshold {
+			fmt.Fprintf(os.Stderr, "Budget warning: %s has used %.0f%% of its budget (%s of %s)\n",
+				formatHeader(b.path, b.handle), b.percent(), formatDuration(b.used), formatDuration(b.budget))
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package tools
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// A sync bundle carries the synchronized data of a clockfile to another one
+// without a time server, e.g. on a USB stick to an air-gapped machine.
+// It is the same payload as sent by 'p sync', but contains all records and
+// deletions. Records are matched by UUID, the later change wins.
+
+func ExportBundle(db *sql.DB, w io.Writer) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args := syncRecords(tx, true)
+	args.Owner = viper.GetString("timeserver.owner")
+	args.Revision = GetParamInt(tx, "revision", 0)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(args); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d/%d/%d/%d/%d (headers/entries/logs/todos/deleted)\n",
+		len(*args.Headers), len(*args.Entries), len(*args.Logs), len(*args.Todos), len(*args.Deleted))
+	return nil
+}
+
+// localIsNewer tells if the clockfile has a change (or deletion) of the object
+// that is at least as recent as the one in the bundle.
+func localIsNewer(tx *sql.Tx, objectType string, uuid string, modified *time.Time) bool {
+	obj := syncObjects[objectType]
+	var local *time.Time
+	found := false
+	rows := dbQ(tx.Query, fmt.Sprintf(`select update_date from %s where %s = ?`, obj.table, obj.uuidColumn), uuid)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if rows.Next() {
+		rows.Scan(&local)
+		found = true
+	}
+	rd := dbQ(tx.Query, `select deletion_date from tombstones where object_uuid = ?`, uuid)
+	defer rd.Close()
+	defer checkDBErr(rd)
+	if rd.Next() {
+		var deleted *time.Time
+		rd.Scan(&deleted)
+		if !found || (deleted != nil && (local == nil || deleted.After(*local))) {
+			local = deleted
+		}
+		found = true
+	}
+	switch {
+	case !found:
+		return false
+	case modified == nil:
+		return true
+	case local == nil:
+		return false
+	default:
+		return !local.Before(*modified)
+	}
+}
+
+func ImportBundle(tx *sql.Tx, r io.Reader) error {
+	var args SyncArgs
+	if err := json.NewDecoder(r).Decode(&args); err != nil {
+		return err
+	}
+	if args.Headers == nil || args.Entries == nil {
+		return errors.New("Not a sync bundle")
+	}
+	if owner := viper.GetString("timeserver.owner"); owner != "" && args.Owner != "" && owner != args.Owner {
+		return fmt.Errorf("The bundle belongs to owner %s, not %s", args.Owner, owner)
+	}
+	imported, skipped := 0, 0
+	for _, h := range *args.Headers {
+		if localIsNewer(tx, "header", h.UUID, h.UpdateDate) {
+			skipped++
+			continue
+		}
+		storeHeader(tx, h)
+		_ = dbX(tx.Exec, `delete from tombstones where object_uuid=?`, h.UUID)
+		imported++
+	}
+	if args.Merges != nil {
+		for _, m := range *args.Merges {
+			storeMerge(tx, m, m.Revision)
+		}
+	}
+	for _, e := range *args.Entries {
+		if localIsNewer(tx, "entry", e.UUID, e.UpdateDate) {
+			skipped++
+			continue
+		}
+		storeEntry(tx, e)
+		_ = dbX(tx.Exec, `delete from tombstones where object_uuid=?`, e.UUID)
+		imported++
+	}
+	if args.Logs != nil {
+		for _, l := range *args.Logs {
+			if localIsNewer(tx, "log", l.UUID, l.UpdateDate) {
+				skipped++
+				continue
+			}
+			storeLog(tx, l)
+			_ = dbX(tx.Exec, `delete from tombstones where object_uuid=?`, l.UUID)
+			imported++
+		}
+	}
+	if args.Todos != nil {
+		for _, t := range *args.Todos {
+			if localIsNewer(tx, "todo", t.UUID, t.UpdateDate) {
+				skipped++
+				continue
+			}
+			storeTodo(tx, t)
+			_ = dbX(tx.Exec, `delete from tombstones where object_uuid=?`, t.UUID)
+			imported++
+		}
+	}
+	deleted := 0
+	if args.Deleted != nil {
+		for _, t := range *args.Deleted {
+			if _, ok := syncObjects[t.Type]; !ok || localIsNewer(tx, t.Type, t.UUID, t.DeletionDate) {
+				continue
+			}
+			applyDeletion(tx, t, t.Revision)
+			deleted++
+		}
+	}
+	if args.Merges != nil {
+		for _, m := range *args.Merges {
+			redirectMerge(tx, m)
+		}
+	}
+	fmt.Printf("Imported %d records and %d deletions, skipped %d (unchanged or newer here)\n", imported, deleted, skipped)
+	return nil
+}
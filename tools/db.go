@@ -16,13 +16,19 @@ type JSONHeader struct {
 	//ID           json.ObjectId `json:"_id,omitempty"`
 	//HeaderUUID string `json:"uuid"`
 	//Owner        string    `json:"owner,omitempty"`
-	Revision     int        `json:"revision"`
-	Header       string     `json:"header"`
-	Handle       string     `json:"handle"`
-	Active       bool       `json:"active"`
-	CreationDate *time.Time `json:"creation_date"`
-	//UpdateDate   time.Time `json:"update_date"`
-	Data *map[string]interface{} `json:"data,omitempty"`
+	Revision     int                     `json:"revision"`
+	Header       string                  `json:"header"`
+	Handle       string                  `json:"handle"`
+	ParentUUID   string                  `json:"parent_uuid,omitempty"`
+	Client       string                  `json:"client,omitempty"`
+	Billable     *bool                   `json:"billable,omitempty"`
+	Rate         float64                 `json:"rate,omitempty"`
+	Currency     string                  `json:"currency,omitempty"`
+	Budget       int64                   `json:"budget,omitempty"` // seconds
+	Active       bool                    `json:"active"`
+	CreationDate *time.Time              `json:"creation_date"`
+	UpdateDate   *time.Time              `json:"update_date,omitempty"`
+	Data         *map[string]interface{} `json:"data,omitempty"`
 }
 
 type JSONEntry struct {
@@ -34,7 +40,98 @@ type JSONEntry struct {
 	Start      *time.Time              `json:"start"`
 	End        *time.Time              `json:"end,omitempty"`
 	Data       *map[string]interface{} `json:"data,omitempty"`
-	//UpdateDate time.Time  `json:"update_date"`
+	UpdateDate *time.Time              `json:"update_date,omitempty"`
+}
+
+type JSONLog struct {
+	UUID         string     `json:"uuid"`
+	Revision     int        `json:"revision"`
+	CreationDate *time.Time `json:"creation_date"`
+	Text         string     `json:"text"`
+	HeaderUUID   string     `json:"header_uuid,omitempty"`
+	UpdateDate   *time.Time `json:"update_date,omitempty"`
+}
+
+type JSONTodo struct {
+	UUID         string     `json:"uuid"`
+	Revision     int        `json:"revision"`
+	Title        string     `json:"title"`
+	Handle       string     `json:"handle"`
+	CreationDate *time.Time `json:"creation_date"`
+	DoneDate     *time.Time `json:"done_date,omitempty"`
+	UpdateDate   *time.Time `json:"update_date,omitempty"`
+}
+
+// JSONTombstone records the deletion of a header, entry, log or todo,
+// so that the deletion can be synchronized.
+type JSONTombstone struct {
+	UUID         string     `json:"uuid"`
+	Type         string     `json:"type"`
+	Revision     int        `json:"revision"`
+	DeletionDate *time.Time `json:"deletion_date"`
+}
+
+// JSONMerge records that a header was merged into another one, so that
+// records still referring to the old header can be redirected.
+type JSONMerge struct {
+	FromUUID  string     `json:"from_uuid"`
+	IntoUUID  string     `json:"into_uuid"`
+	Revision  int        `json:"revision"`
+	MergeDate *time.Time `json:"merge_date"`
+}
+
+// SyncConflict reports a record that was changed on the server and the client
+// since the last sync. The newer change wins.
+type SyncConflict struct {
+	Type        string `json:"type"`
+	UUID        string `json:"uuid"`
+	Description string `json:"description"`
+	Winner      string `json:"winner"` // client or server
+}
+
+type SyncArgs struct {
+	Owner    string           `json:"owner"`
+	Revision int              `json:"revision"`
+	Key      string           `json:"key"`
+	Headers  *[]JSONHeader    `json:"headers"`
+	Entries  *[]JSONEntry     `json:"entries"`
+	Logs     *[]JSONLog       `json:"logs"`
+	Todos    *[]JSONTodo      `json:"todos"`
+	Deleted  *[]JSONTombstone `json:"deleted"`
+	Merges   *[]JSONMerge     `json:"merges,omitempty"`
+	DryRun   bool             `json:"dry_run,omitempty"` // the server does not store anything
+}
+
+// Pushes tells if the client sends any changes.
+func (args *SyncArgs) Pushes() bool {
+	return (args.Headers != nil && len(*args.Headers) > 0) || (args.Entries != nil && len(*args.Entries) > 0) ||
+		(args.Logs != nil && len(*args.Logs) > 0) || (args.Todos != nil && len(*args.Todos) > 0) ||
+		(args.Deleted != nil && len(*args.Deleted) > 0) || (args.Merges != nil && len(*args.Merges) > 0)
+}
+
+type SyncReply struct {
+	Owner     string          `json:"owner"`
+	Revision  int             `json:"revision"`
+	Headers   []JSONHeader    `json:"headers"`
+	Entries   []JSONEntry     `json:"entries"`
+	Logs      []JSONLog       `json:"logs"`
+	Todos     []JSONTodo      `json:"todos"`
+	Deleted   []JSONTombstone `json:"deleted"`
+	Merges    []JSONMerge     `json:"merges,omitempty"`
+	Conflicts []SyncConflict  `json:"conflicts,omitempty"`
+}
+
+type syncObject struct {
+	table       string // in the clockfile
+	serverTable string // in the time server database
+	uuidColumn  string
+}
+
+var syncObjects = map[string]syncObject{
+	"header": {"headers", "sync_headers", "header_uuid"},
+	"entry":  {"entries", "sync_entries", "entry_uuid"},
+	"log":    {"log", "sync_logs", "log_uuid"},
+	"todo":   {"todo", "sync_todos", "todo_uuid"},
 }
 
 func dbDebug(action string, elapsed time.Duration, query string, res *sql.Result, args ...interface{}) {
@@ -92,6 +189,15 @@ func SetParam(tx *sql.Tx, param string, value string) {
 	}
 }
 
+// upsert runs the update and, if that did not find the row, the insert.
+// Both statements take the same arguments.
+func upsert(tx *sql.Tx, update string, insert string, args ...interface{}) {
+	res := dbX(tx.Exec, update, args...)
+	if updatedCnt, _ := res.RowsAffected(); updatedCnt == 0 {
+		_ = dbX(tx.Exec, insert, args...)
+	}
+}
+
 func SetParamInt(tx *sql.Tx, param string, value int) {
 	SetParam(tx, param, strconv.Itoa(value))
 }
@@ -102,60 +208,169 @@ func GetParamInt(tx *sql.Tx, param string, whenNew int) int {
 	return v
 }
 
-func GetUncommitted(tx *sql.Tx) (*[]JSONHeader, *[]JSONEntry) {
+// GetUncommitted collects everything that was changed since the last sync.
+func GetUncommitted(tx *sql.Tx) *SyncArgs {
+	return syncRecords(tx, false)
+}
+
+// syncRecords collects the uncommitted (or all) records and deletions.
+func syncRecords(tx *sql.Tx, all bool) *SyncArgs {
 	hdrs := make([]JSONHeader, 0, 5)
 	entr := make([]JSONEntry, 0, 10)
-	rh := dbQ(tx.Query, `select header_uuid, header, handle, active, creation_date from headers where coalesce(revision,'')=''`)
+	logs := make([]JSONLog, 0, 5)
+	todos := make([]JSONTodo, 0, 5)
+	deleted := make([]JSONTombstone, 0)
+	merges := make([]JSONMerge, 0)
+	rh := dbQ(tx.Query, `select header_uuid, coalesce(revision,0), header, coalesce(handle,''), coalesce(parent_uuid,''), active, creation_date, update_date,
+	coalesce(client,''), billable, coalesce(rate,0), coalesce(currency,''), coalesce(budget,0) from headers
+	where ?1 or coalesce(revision,'')=''`, all)
 	defer rh.Close()
 	defer checkDBErr(rh)
 	for rh.Next() {
 		h := JSONHeader{}
 		//var active bool // column created as "boolean" -> this works
-		rh.Scan(&h.UUID, &h.Header, &h.Handle, &h.Active, &h.CreationDate)
+		rh.Scan(&h.UUID, &h.Revision, &h.Header, &h.Handle, &h.ParentUUID, &h.Active, &h.CreationDate, &h.UpdateDate,
+			&h.Client, &h.Billable, &h.Rate, &h.Currency, &h.Budget)
 		//panic("exit")
 		hdrs = append(hdrs, h)
 	}
-	re := dbQ(tx.Query, `select e.entry_uuid, h.header_uuid, e.start, e.end from entries e
+	re := dbQ(tx.Query, `select e.entry_uuid, coalesce(e.revision,0), h.header_uuid, e.start, e.end, e.update_date from entries e
 	join headers h on h.header_id = e.header_id
-	where coalesce(e.revision,'')=''`)
+	where ?1 or coalesce(e.revision,'')=''`, all)
 	defer re.Close()
 	defer checkDBErr(re)
 	for re.Next() {
 		e := JSONEntry{}
-		re.Scan(&e.UUID, &e.HeaderUUID, &e.Start, &e.End)
+		re.Scan(&e.UUID, &e.Revision, &e.HeaderUUID, &e.Start, &e.End, &e.UpdateDate)
 		entr = append(entr, e)
 	}
+	rl := dbQ(tx.Query, `select log_uuid, coalesce(revision,0), creation_date, log_text, coalesce(header_uuid,''), update_date from log
+	where ?1 or coalesce(revision,'')=''`, all)
+	defer rl.Close()
+	defer checkDBErr(rl)
+	for rl.Next() {
+		l := JSONLog{}
+		rl.Scan(&l.UUID, &l.Revision, &l.CreationDate, &l.Text, &l.HeaderUUID, &l.UpdateDate)
+		logs = append(logs, l)
+	}
+	rt := dbQ(tx.Query, `select todo_uuid, coalesce(revision,0), title, handle, creation_date, done_date, update_date from todo
+	where ?1 or coalesce(revision,'')=''`, all)
+	defer rt.Close()
+	defer checkDBErr(rt)
+	for rt.Next() {
+		t := JSONTodo{}
+		rt.Scan(&t.UUID, &t.Revision, &t.Title, &t.Handle, &t.CreationDate, &t.DoneDate, &t.UpdateDate)
+		todos = append(todos, t)
+	}
+	rd := dbQ(tx.Query, `select object_uuid, object_type, coalesce(revision,0), deletion_date from tombstones
+	where ?1 or coalesce(revision,'')=''`, all)
+	defer rd.Close()
+	defer checkDBErr(rd)
+	for rd.Next() {
+		t := JSONTombstone{}
+		rd.Scan(&t.UUID, &t.Type, &t.Revision, &t.DeletionDate)
+		deleted = append(deleted, t)
+	}
+	rm := dbQ(tx.Query, `select from_uuid, into_uuid, coalesce(revision,0), merge_date from header_merges
+	where ?1 or coalesce(revision,'')=''`, all)
+	defer rm.Close()
+	defer checkDBErr(rm)
+	for rm.Next() {
+		m := JSONMerge{}
+		rm.Scan(&m.FromUUID, &m.IntoUUID, &m.Revision, &m.MergeDate)
+		merges = append(merges, m)
+	}
 
-	return &hdrs, &entr
+	return &SyncArgs{Headers: &hdrs, Entries: &entr, Logs: &logs, Todos: &todos, Deleted: &deleted, Merges: &merges}
 }
 
 func CommitRevision(tx *sql.Tx, revision int) error {
 	_ = dbX(tx.Exec, `update headers set revision=? where revision is null`, revision)
 	_ = dbX(tx.Exec, `update entries set revision=? where revision is null`, revision)
+	_ = dbX(tx.Exec, `update log set revision=? where revision is null`, revision)
+	_ = dbX(tx.Exec, `update todo set revision=? where revision is null`, revision)
+	_ = dbX(tx.Exec, `update tombstones set revision=? where revision is null`, revision)
+	_ = dbX(tx.Exec, `update header_merges set revision=? where revision is null`, revision)
 	return nil
 }
 
-func ApplyUpdates(tx *sql.Tx, hdr []JSONHeader, entr []JSONEntry, revision int) error {
-	if len(hdr) == 0 && len(entr) == 0 {
-		return nil
-	}
-	for _, h := range hdr {
-		active := 1
-		if h.Active {
-			active = 0
-		}
-		_ = dbX(tx.Exec, `insert or replace into headers
-					(header_uuid, header, handle, active, creation_date, revision)
-					values (?, ?, ?, ?, ?, ?)`,
-			h.UUID, h.Header, h.Handle, active, h.CreationDate, revision)
-		//log.Println("UpH:", res)
-	}
-	for _, e := range entr {
-		_ = dbX(tx.Exec, `insert or replace into entries
-					(entry_uuid, header_id, start, end, revision)
-					values (?,(select header_id from headers where header_uuid=?),?,?,?)`,
-			e.UUID, e.HeaderUUID, e.Start, e.End, revision)
-		//log.Println("UpE:", res)
+// addTombstone remembers a deletion until it is synchronized.
+func addTombstone(tx *sql.Tx, objectType string, uuid string) {
+	if uuid == "" {
+		return // never synchronized
+	}
+	upsert(tx, `update tombstones set object_type=?2, deletion_date=?3, revision=null where object_uuid=?1`,
+		`insert into tombstones (object_uuid, object_type, deletion_date) values (?1, ?2, ?3)`,
+		uuid, objectType, time.Now())
+}
+
+// applyDeletion removes an object deleted elsewhere. The entries of a deleted
+// header go along, the time server sends their deletion as well.
+func applyDeletion(tx *sql.Tx, t JSONTombstone, revision int) {
+	obj, ok := syncObjects[t.Type]
+	if !ok {
+		d("Ignoring deletion of unknown type ", t.Type)
+		return
+	}
+	if t.Type == "header" {
+		_ = dbX(tx.Exec, `delete from entries where header_id in (select header_id from headers where header_uuid = ?)`, t.UUID)
+	}
+	_ = dbX(tx.Exec, fmt.Sprintf(`delete from %s where %s = ?`, obj.table, obj.uuidColumn), t.UUID)
+	upsert(tx, `update tombstones set object_type=?2, deletion_date=?3, revision=nullif(?4,0) where object_uuid=?1`,
+		`insert into tombstones (object_uuid, object_type, deletion_date, revision) values (?1, ?2, ?3, nullif(?4,0))`,
+		t.UUID, t.Type, t.DeletionDate, revision)
+}
+
+// ApplyUpdates stores the changes fetched from the time server.
+func ApplyUpdates(tx *sql.Tx, reply *SyncReply) error {
+	revision := reply.Revision
+	for _, h := range reply.Headers {
+		// not "insert or replace": that would give the header a new header_id
+		upsert(tx, `update headers set header=?2, handle=nullif(?3,''), active=?4, creation_date=?5, update_date=?6, revision=?7,
+			parent_uuid=nullif(?8,''), client=nullif(?9,''), billable=?10, rate=nullif(?11,0), currency=nullif(?12,''), budget=nullif(?13,0)
+			where header_uuid=?1`,
+			`insert into headers (header_uuid, header, handle, active, creation_date, update_date, revision, parent_uuid,
+			client, billable, rate, currency, budget)
+			values (?1, ?2, nullif(?3,''), ?4, ?5, ?6, ?7, nullif(?8,''), nullif(?9,''), ?10, nullif(?11,0), nullif(?12,''), nullif(?13,0))`,
+			h.UUID, h.Header, h.Handle, h.Active, h.CreationDate, h.UpdateDate, revision, h.ParentUUID,
+			h.Client, h.Billable, h.Rate, h.Currency, h.Budget)
+		_ = dbX(tx.Exec, `delete from tombstones where object_uuid=?`, h.UUID)
+	}
+	for _, m := range reply.Merges {
+		storeMerge(tx, m, revision)
+	}
+	for _, e := range reply.Entries {
+		e.HeaderUUID = mergedHeaderUUID(tx, e.HeaderUUID)
+		upsert(tx, `update entries set header_id=(select header_id from headers where header_uuid=?2),
+			start=?3, end=?4, update_date=?5, revision=?6
+			where entry_uuid=?1`,
+			`insert into entries (entry_uuid, header_id, start, end, update_date, revision)
+			values (?1, (select header_id from headers where header_uuid=?2), ?3, ?4, ?5, ?6)`,
+			e.UUID, e.HeaderUUID, e.Start, e.End, e.UpdateDate, revision)
+		_ = dbX(tx.Exec, `delete from tombstones where object_uuid=?`, e.UUID)
+	}
+	for _, l := range reply.Logs {
+		l.HeaderUUID = mergedHeaderUUID(tx, l.HeaderUUID)
+		upsert(tx, `update log set creation_date=?2, log_text=?3, header_uuid=nullif(?4,''), update_date=?5, revision=?6
+			where log_uuid=?1`,
+			`insert into log (log_uuid, creation_date, log_text, header_uuid, update_date, revision)
+			values (?1, ?2, ?3, nullif(?4,''), ?5, ?6)`,
+			l.UUID, l.CreationDate, l.Text, l.HeaderUUID, l.UpdateDate, revision)
+		_ = dbX(tx.Exec, `delete from tombstones where object_uuid=?`, l.UUID)
+	}
+	for _, t := range reply.Todos {
+		upsert(tx, `update todo set title=?2, handle=?3, creation_date=?4, done_date=?5, update_date=?6, revision=?7
+			where todo_uuid=?1`,
+			`insert into todo (todo_uuid, title, handle, creation_date, done_date, update_date, revision)
+			values (?1, ?2, ?3, ?4, ?5, ?6, ?7)`,
+			t.UUID, t.Title, t.Handle, t.CreationDate, t.DoneDate, t.UpdateDate, revision)
+		_ = dbX(tx.Exec, `delete from tombstones where object_uuid=?`, t.UUID)
+	}
+	for _, t := range reply.Deleted {
+		applyDeletion(tx, t, revision)
+	}
+	for _, m := range reply.Merges {
+		redirectMerge(tx, m)
 	}
 	return nil
 }
@@ -0,0 +1,325 @@
+package tools
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var shortDateTime = "2006-01-02 15:04"
+
+type EntryInfo struct {
+	Id     RowId
+	UUID   string
+	Header string
+	Handle string
+	Start  time.Time
+	End    *time.Time
+}
+
+func (e EntryInfo) String() string {
+	end := "..."
+	if e.End != nil {
+		end = e.End.Format(timeFormat)
+		if simpleDate(*e.End) != simpleDate(e.Start) {
+			end = e.End.Format(shortDateTime)
+		}
+	}
+	return fmt.Sprintf("[%d] %s -- %s  %s", e.Id,
+		e.Start.Format(shortDateTime), end, formatHeader(e.Header, e.Handle))
+}
+
+func GetEntry(tx *sql.Tx, id RowId) (*EntryInfo, error) {
+	rows := dbQ(tx.Query, `select e.entry_id, e.entry_uuid, h.header, coalesce(h.handle,''), e.start, e.end
+	from entries e
+	join headers h on h.header_id = e.header_id
+	where e.entry_id = ?`, id)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if !rows.Next() {
+		return nil, fmt.Errorf("No entry with number %d", id)
+	}
+	var e EntryInfo
+	var uuid *string
+	rows.Scan(&e.Id, &uuid, &e.Header, &e.Handle, &e.Start, &e.End)
+	e.UUID = nvl(uuid, "")
+	return &e, nil
+}
+
+// FindEntryId decodes an entry reference: either "last" (the most recently
+// started entry) or the entry number as shown by ListEntries.
+func FindEntryId(tx *sql.Tx, ref string) (RowId, error) {
+	if ref == "" {
+		return RowId(0), errors.New("Need an entry number (or 'last')")
+	}
+	if ref == "last" {
+		rows := dbQ(tx.Query, `select entry_id from entries order by start desc limit 1`)
+		defer rows.Close()
+		defer checkDBErr(rows)
+		if !rows.Next() {
+			return RowId(0), errors.New("There are no entries yet")
+		}
+		var id int64
+		rows.Scan(&id)
+		return RowId(id), nil
+	}
+	id, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil || id <= 0 {
+		return RowId(0), fmt.Errorf("Not a valid entry number: %s", ref)
+	}
+	return RowId(id), nil
+}
+
+// parseClockTime parses a time of day ("9:10", "09:10") relative to the given day,
+// or a full date and time ("2016-10-12 09:10").
+func parseClockTime(s string, day time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{shortDateTime, "2006-01-02T15:04", isoDateTime} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	t, err := time.ParseInLocation("15:04", s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("Could not understand time '%s', use HH:MM or YYYY-MM-DD HH:MM", s)
+	}
+	y, m, dd := day.Date()
+	return time.Date(y, m, dd, t.Hour(), t.Minute(), 0, 0, time.Local), nil
+}
+
+// checkOverlap verifies that no entry other than exclude touches the period start--end.
+// An open period (end==nil) or an open entry counts as running until effectiveTimeNow.
+func checkOverlap(tx *sql.Tx, exclude RowId, start time.Time, end *time.Time, effectiveTimeNow time.Time) error {
+	until := effectiveTimeNow
+	if end != nil {
+		until = *end
+	}
+	rows := dbQ(tx.Query, `select e.entry_id, e.start, e.end, h.header, coalesce(h.handle,'')
+	from entries e
+	join headers h on h.header_id = e.header_id
+	where e.entry_id <> ?
+	and e.start < ?
+	and coalesce(e.end, ?) > ?
+	order by e.start`, exclude, until, effectiveTimeNow, start)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if rows.Next() {
+		var e EntryInfo
+		rows.Scan(&e.Id, &e.Start, &e.End, &e.Header, &e.Handle)
+		return fmt.Errorf("Overlaps with existing entry %s", e)
+	}
+	return nil
+}
+
+var clockRangeRE = regexp.MustCompile(`^(\d{1,2}:\d{2})-(\d{1,2}:\d{2})$`)
+var clockTimeRE = regexp.MustCompile(`^\d{1,2}:\d{2}$`)
+var dateRE = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+// ParseTimeRange extracts a closed time period from the arguments, the remaining
+// arguments are returned. Understood are a day (today, yesterday, today-3, 2016-10-12,
+// default today) and either a range (13:00-14:15), start and end (13:00 14:15)
+// or start and duration (9:00 1h30m). An end before the start is refused, entries
+// past midnight are given with a duration (23:00 2h).
+func ParseTimeRange(argv []string, effectiveTimeNow time.Time) (start, end time.Time, rest []string, err error) {
+	y, m, dd := effectiveTimeNow.Date()
+	day := time.Date(y, m, dd, 0, 0, 0, 0, time.Local)
+	var times []string
+	var duration time.Duration
+	for _, a := range argv {
+		lower := strings.ToLower(a)
+		if s := clockRangeRE.FindStringSubmatch(a); s != nil {
+			times = append(times, s[1], s[2])
+		} else if clockTimeRE.MatchString(a) {
+			times = append(times, a)
+		} else if dateRE.MatchString(a) {
+			if day, err = time.ParseInLocation(simpleDateFormat, a, time.Local); err != nil {
+				return
+			}
+		} else if parts := strings.Split(lower, "-"); parts[0] == "today" || parts[0] == "yesterday" {
+			// same notation as the time-frames: today, yesterday, today-2
+			back := 0
+			if len(parts) > 1 {
+				if back, err = strconv.Atoi(parts[1]); err != nil {
+					return
+				}
+			}
+			if parts[0] == "yesterday" {
+				back++
+			}
+			day = time.Date(y, m, dd-back, 0, 0, 0, 0, time.Local)
+		} else if dur, derr := time.ParseDuration(a); derr == nil && len(times) == 1 {
+			duration = dur
+		} else {
+			rest = append(rest, a)
+		}
+	}
+	switch {
+	case len(times) == 1 && duration > 0:
+		if start, err = parseClockTime(times[0], day); err != nil {
+			return
+		}
+		end = start.Add(duration)
+	case len(times) == 2 && duration == 0:
+		if start, err = parseClockTime(times[0], day); err != nil {
+			return
+		}
+		if end, err = parseClockTime(times[1], day); err != nil {
+			return
+		}
+		if end.Before(start) {
+			err = fmt.Errorf("End %s is before start %s, use a duration for entries past midnight (%s 2h)",
+				times[1], times[0], times[0])
+			return
+		}
+	default:
+		err = errors.New("Need a time range: HH:MM-HH:MM, HH:MM HH:MM or HH:MM and a duration")
+		return
+	}
+	if !start.Before(end) {
+		err = fmt.Errorf("Start %s must be before end %s", start.Format(shortDateTime), end.Format(shortDateTime))
+	}
+	return
+}
+
+// insertEntry adds a closed entry unless it overlaps with another one.
+func insertEntry(tx *sql.Tx, hdr RowId, start, end time.Time, effectiveTimeNow time.Time) (RowId, error) {
+	if err := checkOverlap(tx, RowId(0), start, &end, effectiveTimeNow); err != nil {
+		return RowId(0), err
+	}
+	return addTime(tx, orgEntry{lType: clock, start: &start, end: &end}, hdr), nil
+}
+
+// AddEntry inserts a closed entry afterwards, e.g. for a forgotten meeting.
+func AddEntry(tx *sql.Tx, argv []string, handle string, effectiveTimeNow time.Time) error {
+	start, end, rest, err := ParseTimeRange(argv, effectiveTimeNow)
+	if err != nil {
+		return err
+	}
+	var header string
+	if handle == "" {
+		if len(rest) < 1 {
+			return fmt.Errorf("Need a handle (or part of header) to add an entry")
+		}
+		header = strings.Join(rest, " ")
+	}
+	hdr, _, err := findHeader(tx, header, handle)
+	if err != nil {
+		return err
+	}
+	id, err := insertEntry(tx, hdr, start, end, effectiveTimeNow)
+	if err != nil {
+		return err
+	}
+	e, err := GetEntry(tx, id)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Added", e)
+	return nil
+}
+
+func EditEntry(tx *sql.Tx, id RowId, start string, end string, header string, effectiveTimeNow time.Time) error {
+	e, err := GetEntry(tx, id)
+	if err != nil {
+		return err
+	}
+	if start == "" && end == "" && header == "" {
+		fmt.Println(e)
+		return nil
+	}
+	newStart := e.Start
+	newEnd := e.End
+	if start != "" {
+		if newStart, err = parseClockTime(start, e.Start); err != nil {
+			return err
+		}
+	}
+	if end != "" {
+		// the end defaults to the (possibly new) start day
+		t, err := parseClockTime(end, newStart)
+		if err != nil {
+			return err
+		}
+		newEnd = &t
+	}
+	if newEnd != nil && !newStart.Before(*newEnd) {
+		return fmt.Errorf("Start %s must be before end %s",
+			newStart.Format(shortDateTime), newEnd.Format(shortDateTime))
+	}
+	if newEnd == nil && newStart.After(effectiveTimeNow) {
+		return fmt.Errorf("A running entry can not start in the future")
+	}
+	if err := checkOverlap(tx, id, newStart, newEnd, effectiveTimeNow); err != nil {
+		return err
+	}
+	hdr, err := entryHeaderId(tx, id)
+	if err != nil {
+		return err
+	}
+	if header != "" {
+		handle, args := ParseHandle([]string{header})
+		if hdr, _, err = findHeader(tx, FirstOrEmpty(args), handle); err != nil {
+			return err
+		}
+	}
+	_ = dbX(tx.Exec, `update entries set start=?, end=?, header_id=?, revision=null, update_date=? where entry_id=?`,
+		newStart, newEnd, hdr, time.Now(), id)
+	if e, err = GetEntry(tx, id); err != nil {
+		return err
+	}
+	fmt.Println("Changed", e)
+	return nil
+}
+
+func entryHeaderId(tx *sql.Tx, id RowId) (RowId, error) {
+	rows := dbQ(tx.Query, `select header_id from entries where entry_id = ?`, id)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if !rows.Next() {
+		return RowId(0), fmt.Errorf("No entry with number %d", id)
+	}
+	var hdr int64
+	rows.Scan(&hdr)
+	return RowId(hdr), nil
+}
+
+func DeleteEntry(tx *sql.Tx, id RowId) error {
+	e, err := GetEntry(tx, id)
+	if err != nil {
+		return err
+	}
+	_ = dbX(tx.Exec, `delete from entries where entry_id=?`, id)
+	addTombstone(tx, "entry", e.UUID)
+	fmt.Println("Deleted", e)
+	return nil
+}
+
+func ListEntries(db *sql.DB, argv []string) error {
+	from, to, err := DecodeTimeFrame(FirstOrEmpty(argv))
+	if err != nil {
+		return err
+	}
+	var filter string
+	if len(argv) > 1 {
+		filter = argv[1]
+	}
+	rows := dbQ(db.Query, `select e.entry_id, h.header, coalesce(h.handle,''), e.start, e.end
+	from entries e
+	join headers h on h.header_id = e.header_id
+	where e.start between ? and ?
+	and (lower(h.header) like lower('%'||?||'%') or '@'||h.handle = ?)
+	order by e.start asc`, from, to, filter, filter)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	fmt.Println("Entries:", printTimeFrame(&from, &to))
+	for rows.Next() {
+		var e EntryInfo
+		rows.Scan(&e.Id, &e.Header, &e.Handle, &e.Start, &e.End)
+		fmt.Println(e)
+	}
+	return nil
+}
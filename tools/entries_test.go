@@ -0,0 +1,50 @@
+package tools
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestEditEntry(t *testing.T) {
+	db := testDB(t)
+	day := time.Date(2016, 10, 3, 0, 0, 0, 0, time.Local)
+	at := func(hour, min int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute)
+	}
+	now := at(17, 0)
+	testTx(t, db, func(tx *sql.Tx) {
+		hdr, _ := AddHeader(tx, "Project", "proj", "")
+		AddHeader(tx, "Other", "other", "")
+		first, _ := insertEntry(tx, hdr, at(9, 0), at(10, 0), now)
+		second, _ := insertEntry(tx, hdr, at(11, 0), at(12, 0), now)
+		_, err := insertEntry(tx, hdr, at(9, 30), at(10, 30), now)
+		assert(t, err != nil, "an overlapping entry is refused")
+		_ = dbX(tx.Exec, `update entries set revision = 1`)
+
+		assert(t, EditEntry(tx, first, "", "11:30", "", now) != nil, "an end overlapping the next entry is refused")
+		assert(t, EditEntry(tx, second, "09:45", "", "", now) != nil, "a start overlapping the previous entry is refused")
+		assert(t, EditEntry(tx, first, "", "08:00", "", now) != nil, "an end before the start is refused")
+		e, _ := GetEntry(tx, first)
+		assert(t, e.End.Equal(at(10, 0)), "refused edits change nothing")
+		assert(t, count(t, tx, `select count(*) from entries where revision is null`) == 0, "nor mark anything for sync")
+
+		assert(t, EditEntry(tx, first, "", "11:00", "", now) == nil, "an end touching the next entry is fine")
+		assert(t, EditEntry(tx, first, "08:30", "", "@other", now) == nil, "start and header are changed")
+		e, _ = GetEntry(tx, first)
+		assert(t, e.Start.Equal(at(8, 30)) && e.End.Equal(at(11, 0)) && e.Handle == "other", "the changes are stored")
+		assert(t, count(t, tx, `select count(*) from entries where revision is null`) == 1, "the change is synced")
+
+		running := at(16, 0)
+		open := addTime(tx, orgEntry{start: &running}, hdr)
+		assert(t, EditEntry(tx, second, "", "16:30", "", now) != nil, "an end within the running entry is refused")
+		assert(t, EditEntry(tx, open, "18:00", "", "", now) != nil, "a running entry can not start in the future")
+
+		assert(t, DeleteEntry(tx, second) == nil, "an entry is deleted")
+		_, err = GetEntry(tx, second)
+		assert(t, err != nil, "the entry is gone")
+		assert(t, count(t, tx, `select count(*) from tombstones where revision is null`) == 1, "the deletion is synced")
+		assert(t, EditEntry(tx, open, "11:30", "", "", now) == nil, "its time is free again")
+		assert(t, DeleteEntry(tx, second) != nil, "an entry is deleted once")
+	})
+}
@@ -0,0 +1,206 @@
+package tools
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+const exportFormat = "punch"
+const exportVersion = 1
+
+// JSONExport is the complete contents of a clockfile, used for backup and restore.
+type JSONExport struct {
+	Format   string            `json:"format"`
+	Version  int               `json:"version"`
+	Exported time.Time         `json:"exported"`
+	Params   map[string]string `json:"params"`
+	Headers  []JSONHeader      `json:"headers"`
+	Entries  []JSONEntry       `json:"entries"`
+	Logs     []JSONLog         `json:"logs"`
+	Todos    []JSONTodo        `json:"todos"`
+	Merges   []JSONMerge       `json:"merges,omitempty"`
+}
+
+func ExportJSON(db *sql.DB, w io.Writer) error {
+	exp := JSONExport{
+		Format:   exportFormat,
+		Version:  exportVersion,
+		Exported: time.Now(),
+		Params:   make(map[string]string),
+		Headers:  make([]JSONHeader, 0),
+		Entries:  make([]JSONEntry, 0),
+		Logs:     make([]JSONLog, 0),
+		Todos:    make([]JSONTodo, 0),
+	}
+
+	rp := dbQ(db.Query, `select param, value from params`)
+	defer rp.Close()
+	defer checkDBErr(rp)
+	for rp.Next() {
+		var param, value string
+		rp.Scan(&param, &value)
+		exp.Params[param] = value
+	}
+
+	rh := dbQ(db.Query, `select coalesce(header_uuid,''), coalesce(revision,0), header, coalesce(handle,''), coalesce(parent_uuid,''),
+	active, creation_date, update_date,
+	coalesce(client,''), billable, coalesce(rate,0), coalesce(currency,''), coalesce(budget,0)
+	from headers order by header_id`)
+	defer rh.Close()
+	defer checkDBErr(rh)
+	for rh.Next() {
+		h := JSONHeader{}
+		rh.Scan(&h.UUID, &h.Revision, &h.Header, &h.Handle, &h.ParentUUID, &h.Active, &h.CreationDate, &h.UpdateDate,
+			&h.Client, &h.Billable, &h.Rate, &h.Currency, &h.Budget)
+		exp.Headers = append(exp.Headers, h)
+	}
+
+	re := dbQ(db.Query, `select coalesce(e.entry_uuid,''), coalesce(e.revision,0), h.header_uuid, e.start, e.end, e.update_date
+	from entries e
+	join headers h on h.header_id = e.header_id
+	order by e.start`)
+	defer re.Close()
+	defer checkDBErr(re)
+	for re.Next() {
+		e := JSONEntry{}
+		re.Scan(&e.UUID, &e.Revision, &e.HeaderUUID, &e.Start, &e.End, &e.UpdateDate)
+		exp.Entries = append(exp.Entries, e)
+	}
+
+	rl := dbQ(db.Query, `select coalesce(log_uuid,''), coalesce(revision,0), creation_date, log_text, coalesce(header_uuid,''), update_date
+	from log order by creation_date`)
+	defer rl.Close()
+	defer checkDBErr(rl)
+	for rl.Next() {
+		l := JSONLog{}
+		rl.Scan(&l.UUID, &l.Revision, &l.CreationDate, &l.Text, &l.HeaderUUID, &l.UpdateDate)
+		exp.Logs = append(exp.Logs, l)
+	}
+
+	rt := dbQ(db.Query, `select coalesce(todo_uuid,''), coalesce(revision,0), title, coalesce(handle,''), creation_date, done_date, update_date
+	from todo order by todo_id`)
+	defer rt.Close()
+	defer checkDBErr(rt)
+	for rt.Next() {
+		t := JSONTodo{}
+		rt.Scan(&t.UUID, &t.Revision, &t.Title, &t.Handle, &t.CreationDate, &t.DoneDate, &t.UpdateDate)
+		exp.Todos = append(exp.Todos, t)
+	}
+
+	rm := dbQ(db.Query, `select from_uuid, into_uuid, coalesce(revision,0), merge_date
+	from header_merges order by merge_date`)
+	defer rm.Close()
+	defer checkDBErr(rm)
+	for rm.Next() {
+		m := JSONMerge{}
+		rm.Scan(&m.FromUUID, &m.IntoUUID, &m.Revision, &m.MergeDate)
+		exp.Merges = append(exp.Merges, m)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(exp)
+}
+
+// localParams belong to the database they are in, they are not imported:
+// the schema version and the sync position (revision) at the time server.
+var localParams = map[string]bool{"version": true, "revision": true}
+
+func uuidOrNew(uuid string) string {
+	if uuid == "" {
+		return newUUID()
+	}
+	return uuid
+}
+
+// ImportJSON restores an export created by ExportJSON. All records are
+// inserted or updated by their UUID, nothing is deleted.
+func ImportJSON(tx *sql.Tx, r io.Reader) error {
+	var imp JSONExport
+	if err := json.NewDecoder(r).Decode(&imp); err != nil {
+		return err
+	}
+	if imp.Format != exportFormat {
+		return fmt.Errorf("Not a punch export (format '%s')", imp.Format)
+	}
+	if imp.Version > exportVersion {
+		return fmt.Errorf("Export version %d is newer than this program (%d)", imp.Version, exportVersion)
+	}
+	for param, value := range imp.Params {
+		if !localParams[param] {
+			SetParam(tx, param, value)
+		}
+	}
+	for _, h := range imp.Headers {
+		h.UUID = uuidOrNew(h.UUID)
+		storeHeader(tx, h)
+	}
+	for _, m := range imp.Merges {
+		storeMerge(tx, m, m.Revision)
+	}
+	for _, e := range imp.Entries {
+		e.UUID = uuidOrNew(e.UUID)
+		storeEntry(tx, e)
+	}
+	for _, l := range imp.Logs {
+		l.UUID = uuidOrNew(l.UUID)
+		storeLog(tx, l)
+	}
+	for _, t := range imp.Todos {
+		t.UUID = uuidOrNew(t.UUID)
+		storeTodo(tx, t)
+	}
+	fmt.Printf("Imported %d headers, %d entries, %d logs, %d todos (exported %s)\n",
+		len(imp.Headers), len(imp.Entries), len(imp.Logs), len(imp.Todos), imp.Exported.Format(shortDateTime))
+	return nil
+}
+
+// The store functions insert or update a record by its UUID,
+// keeping the revision it has (0 is not yet synchronized).
+
+func storeHeader(tx *sql.Tx, h JSONHeader) {
+	upsert(tx, `update headers set revision=nullif(?2,0), header=?3, handle=?4, active=?5, creation_date=?6, update_date=?7,
+		parent_uuid=nullif(?8,''), client=nullif(?9,''), billable=?10, rate=nullif(?11,0), currency=nullif(?12,''), budget=nullif(?13,0)
+		where header_uuid=?1`,
+		`insert into headers (header_uuid, revision, header, handle, active, creation_date, update_date, parent_uuid,
+		client, billable, rate, currency, budget)
+		values (?1, nullif(?2,0), ?3, ?4, ?5, ?6, ?7, nullif(?8,''), nullif(?9,''), ?10, nullif(?11,0), nullif(?12,''), nullif(?13,0))`,
+		h.UUID, h.Revision, h.Header, h.Handle, h.Active, h.CreationDate, h.UpdateDate, h.ParentUUID,
+		h.Client, h.Billable, h.Rate, h.Currency, h.Budget)
+}
+
+func storeEntry(tx *sql.Tx, e JSONEntry) {
+	e.HeaderUUID = mergedHeaderUUID(tx, e.HeaderUUID)
+	upsert(tx, `update entries set revision=nullif(?2,0),
+		header_id=(select header_id from headers where header_uuid=?3), start=?4, end=?5, update_date=?6
+		where entry_uuid=?1`,
+		`insert into entries (entry_uuid, revision, header_id, start, end, update_date)
+		values (?1, nullif(?2,0), (select header_id from headers where header_uuid=?3), ?4, ?5, ?6)`,
+		e.UUID, e.Revision, e.HeaderUUID, e.Start, e.End, e.UpdateDate)
+}
+
+func storeLog(tx *sql.Tx, l JSONLog) {
+	l.HeaderUUID = mergedHeaderUUID(tx, l.HeaderUUID)
+	upsert(tx, `update log set revision=nullif(?2,0), creation_date=?3, log_text=?4, header_uuid=nullif(?5,''), update_date=?6
+		where log_uuid=?1`,
+		`insert into log (log_uuid, revision, creation_date, log_text, header_uuid, update_date)
+		values (?1, nullif(?2,0), ?3, ?4, nullif(?5,''), ?6)`,
+		l.UUID, l.Revision, l.CreationDate, l.Text, l.HeaderUUID, l.UpdateDate)
+}
+
+func storeTodo(tx *sql.Tx, t JSONTodo) {
+	upsert(tx, `update todo set revision=nullif(?2,0), title=?3, handle=?4, creation_date=?5, done_date=?6, update_date=?7
+		where todo_uuid=?1`,
+		`insert into todo (todo_uuid, revision, title, handle, creation_date, done_date, update_date)
+		values (?1, nullif(?2,0), ?3, ?4, ?5, ?6, ?7)`,
+		t.UUID, t.Revision, t.Title, t.Handle, t.CreationDate, t.DoneDate, t.UpdateDate)
+}
+
+func storeMerge(tx *sql.Tx, m JSONMerge, revision int) {
+	upsert(tx, `update header_merges set into_uuid=?2, merge_date=?3, revision=nullif(?4,0) where from_uuid=?1`,
+		`insert into header_merges (from_uuid, into_uuid, merge_date, revision) values (?1, ?2, ?3, nullif(?4,0))`,
+		m.FromUUID, m.IntoUUID, m.MergeDate, revision)
+}
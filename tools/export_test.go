@@ -0,0 +1,60 @@
+package tools
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// exportRecords exports the clockfile without the parts expected to differ.
+func exportRecords(t *testing.T, db *sql.DB) string {
+	var buf bytes.Buffer
+	if err := ExportJSON(db, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var exp JSONExport
+	json.Unmarshal(buf.Bytes(), &exp)
+	exp.Exported, exp.Params = time.Time{}, nil
+	records, _ := json.Marshal(exp)
+	return string(records)
+}
+
+func TestExportImportJSON(t *testing.T) {
+	src := testDB(t)
+	start := time.Date(2016, 10, 3, 9, 0, 0, 0, time.UTC)
+	end := start.Add(90 * time.Minute)
+	testTx(t, src, func(tx *sql.Tx) {
+		dev, _ := AddHeader(tx, "Proj:Dev", "dev", "")
+		AddHeader(tx, "Old", "old", "")
+		assert(t, SetHeaderAttributes(tx, "@dev", []string{"client=ACME", "billable=yes", "rate=95", "budget=40h"}) == nil,
+			"attributes are set")
+		addTime(tx, orgEntry{start: &start, end: &end}, dev)
+		LogEntry(tx, []string{"a log"}, start.Add(time.Minute))
+		AddTodo(tx, "a todo", "dev", start)
+		assert(t, MergeHeaders(tx, "@old", "@dev") == nil, "headers are merged")
+		SetParamInt(tx, "revision", 7)
+		SetParam(tx, "mine", "kept")
+	})
+	var exported bytes.Buffer
+	assert(t, ExportJSON(src, &exported) == nil, "export")
+
+	dst := testDB(t)
+	testTx(t, dst, func(tx *sql.Tx) {
+		SetParamInt(tx, "revision", 3)
+		assert(t, ImportJSON(tx, &exported) == nil, "import")
+		assert(t, GetParamInt(tx, "revision", 0) == 3, "the sync position is not imported")
+		assert(t, GetParam(tx, "mine", "") == "kept", "other params are imported")
+		assert(t, GetParamInt(tx, "version", 0) == 13, "the schema version is not imported")
+	})
+	assert(t, exportRecords(t, dst) == exportRecords(t, src), "the import restores every record")
+	testTx(t, dst, func(tx *sql.Tx) {
+		assert(t, headerPath(tx, findHeaderByTitle(tx, "Proj:Dev")) == "Proj:Dev", "the parent is restored")
+		assert(t, count(t, tx, `select count(*) from entries e join headers h on h.header_id = e.header_id where h.handle = 'dev'`) == 1,
+			"the entry is restored")
+		assert(t, count(t, tx, `select count(*) from header_merges`) == 1, "the merge is restored")
+		a := getHeaderAttrs(tx, findHeaderByTitle(tx, "Proj:Dev"))
+		assert(t, a.client == "ACME" && a.rate == 95 && a.budget == 40*time.Hour, "attributes are restored")
+	})
+}
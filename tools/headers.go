@@ -0,0 +1,528 @@
+package tools
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maintenance of the headers. Every change clears the revision and sets
+// update_date, so it goes to the time server with the next sync.
+
+type headerRef struct {
+	id     RowId
+	uuid   string
+	header string
+	handle string
+	active bool
+}
+
+func (h headerRef) String() string {
+	s := fmt.Sprintf("[%d] %s", h.id, formatHeader(h.header, h.handle))
+	if !h.active {
+		s += " (archived)"
+	}
+	return s
+}
+
+// findHeaderRef decodes a header reference: @handle, the header number as
+// shown by 'head list', a handle without @ or a unique part of the title.
+// Archived headers are found as well. Sub-headers match on their path A:B:C,
+// an exact path is preferred over the longer paths below it.
+func findHeaderRef(tx *sql.Tx, ref string) (headerRef, error) {
+	var h headerRef
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return h, errors.New("Need a header (@handle, number or part of the title)")
+	}
+	query := `select h.header_id, coalesce(h.header_uuid,''), coalesce(t.path, h.header), coalesce(h.handle,''), coalesce(h.active,0)
+	from headers h left join header_tree t on t.header_id = h.header_id `
+	var rows *sql.Rows
+	if strings.HasPrefix(ref, "@") {
+		rows = dbQ(tx.Query, query+`where h.handle = ?`, ref[1:])
+	} else if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		rows = dbQ(tx.Query, query+`where h.header_id = ?`, id)
+	} else {
+		rows = dbQ(tx.Query, query+`where h.handle = ?1
+		or (lower(coalesce(t.path, h.header)) like '%'||lower(?1)||'%' and not exists (select 1 from headers where handle = ?1))
+		order by lower(coalesce(t.path, h.header)) = lower(?1) desc, h.active desc, t.path`, ref)
+	}
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if !rows.Next() {
+		return h, fmt.Errorf("No header %s", ref)
+	}
+	rows.Scan(&h.id, &h.uuid, &h.header, &h.handle, &h.active)
+	if strings.EqualFold(h.header, ref) {
+		return h, nil // the full path, its sub-headers match as well
+	}
+	if rows.Next() {
+		var other headerRef
+		rows.Scan(&other.id, &other.uuid, &other.header, &other.handle, &other.active)
+		return h, fmt.Errorf("Too many matching headers: %s, %s", h, other)
+	}
+	return h, nil
+}
+
+func headerRunning(tx *sql.Tx, id RowId) bool {
+	rows := dbQ(tx.Query, `select 1 from entries where header_id = ? and end is null`, id)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	return rows.Next()
+}
+
+func RenameHeader(tx *sql.Tx, ref string, title string) error {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return errors.New("Need the new title")
+	}
+	if strings.Contains(title, ":") {
+		return errors.New("A title can not contain ':', it separates the sub-headers")
+	}
+	h, err := findHeaderRef(tx, ref)
+	if err != nil {
+		return err
+	}
+	_ = dbX(tx.Exec, `update headers set header = ?, revision = null, update_date = ? where header_id = ?`,
+		title, time.Now(), h.id)
+	fmt.Printf("Renamed %s to %s\n", h, title)
+	return nil
+}
+
+// ChangeHandle gives the header a new handle, the TODOs of the old handle move along.
+func ChangeHandle(tx *sql.Tx, ref string, handle string) error {
+	handle = strings.TrimPrefix(strings.TrimSpace(handle), "@")
+	if handle == "" || strings.ContainsAny(handle, " \t@") {
+		return fmt.Errorf("Not a valid handle: '%s'", handle)
+	}
+	h, err := findHeaderRef(tx, ref)
+	if err != nil {
+		return err
+	}
+	if h.handle == handle {
+		return nil
+	}
+	rows := dbQ(tx.Query, `select 1 from headers where handle = ?`, handle)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if rows.Next() {
+		return fmt.Errorf("Handle @%s is already used", handle)
+	}
+	now := time.Now()
+	_ = dbX(tx.Exec, `update headers set handle = ?, revision = null, update_date = ? where header_id = ?`,
+		handle, now, h.id)
+	todos := int64(0)
+	if h.handle != "" {
+		res := dbX(tx.Exec, `update todo set handle = ?, revision = null, update_date = ? where handle = ?`,
+			handle, now, h.handle)
+		todos, _ = res.RowsAffected()
+	}
+	fmt.Printf("Changed the handle of %s to @%s (%d TODOs)\n", h, handle, todos)
+	return nil
+}
+
+// SetHeaderActive archives (active=false) or reactivates a header. Archived
+// headers are left out of the lists and reports, their entries are kept.
+func SetHeaderActive(tx *sql.Tx, ref string, active bool) error {
+	h, err := findHeaderRef(tx, ref)
+	if err != nil {
+		return err
+	}
+	if h.active == active {
+		fmt.Printf("Nothing to do, %s\n", h)
+		return nil
+	}
+	if !active && headerRunning(tx, h.id) {
+		return fmt.Errorf("%s is running, punch out first", h)
+	}
+	_ = dbX(tx.Exec, `update headers set active = ?, revision = null, update_date = ? where header_id = ?`,
+		active, time.Now(), h.id)
+	h.active = active
+	if active {
+		fmt.Printf("Reactivated %s\n", h)
+	} else {
+		fmt.Printf("Archived %s\n", h)
+	}
+	return nil
+}
+
+// MergeHeaders moves the entries, logs and TODOs of one header to another and
+// archives the first. The merge is synchronized, so records of the old header
+// that are still on other machines end up at the new one as well.
+func MergeHeaders(tx *sql.Tx, fromRef string, intoRef string) error {
+	from, err := findHeaderRef(tx, fromRef)
+	if err != nil {
+		return err
+	}
+	into, err := findHeaderRef(tx, intoRef)
+	if err != nil {
+		return err
+	}
+	if from.id == into.id {
+		return fmt.Errorf("Can not merge %s into itself", from)
+	}
+	if isBelow(tx, into.uuid, from.uuid) {
+		// its sub-headers would move below into, which is below them
+		return fmt.Errorf("Can not merge %s into its sub-header %s", from, into)
+	}
+	if !into.active {
+		return fmt.Errorf("%s is archived, unarchive it first", into)
+	}
+	if from.handle != "" && into.handle == "" {
+		rows := dbQ(tx.Query, `select 1 from todo where handle = ?`, from.handle)
+		defer rows.Close()
+		defer checkDBErr(rows)
+		if rows.Next() {
+			return fmt.Errorf("%s has TODOs, give %s a handle first", from, into)
+		}
+	}
+	now := time.Now()
+	res := dbX(tx.Exec, `update entries set header_id = ?, revision = null, update_date = ? where header_id = ?`,
+		into.id, now, from.id)
+	entries, _ := res.RowsAffected()
+	res = dbX(tx.Exec, `update log set header_uuid = ?, revision = null, update_date = ? where header_uuid = ?`,
+		into.uuid, now, from.uuid)
+	logs, _ := res.RowsAffected()
+	todos := int64(0)
+	if from.handle != "" {
+		res = dbX(tx.Exec, `update todo set handle = ?, revision = null, update_date = ? where handle = ?`,
+			into.handle, now, from.handle)
+		todos, _ = res.RowsAffected()
+	}
+	_ = dbX(tx.Exec, `update headers set active = 0, revision = null, update_date = ? where header_id = ?`,
+		now, from.id)
+	_ = dbX(tx.Exec, `update headers set parent_uuid = ?, revision = null, update_date = ?
+	where parent_uuid = ? and header_id <> ?`, into.uuid, now, from.uuid, into.id)
+	// earlier merges into the old header now point to the new one
+	_ = dbX(tx.Exec, `update header_merges set into_uuid = ?, revision = null where into_uuid = ?`,
+		into.uuid, from.uuid)
+	storeMerge(tx, JSONMerge{FromUUID: from.uuid, IntoUUID: into.uuid, MergeDate: &now}, 0)
+	fmt.Printf("Merged %s into %s (%d entries, %d logs, %d TODOs)\n", from, into, entries, logs, todos)
+	return nil
+}
+
+// isBelow tells if the header uuid is a sub-header of ancestor, at any depth.
+func isBelow(tx *sql.Tx, uuid string, ancestor string) bool {
+	return hasAncestor(uuid, ancestor, func(uuid string) string {
+		return queryParent(tx, `select coalesce(parent_uuid,'') from headers where header_uuid = ?`, uuid)
+	})
+}
+
+// queryParent returns the parent_uuid selected by the query, or "".
+func queryParent(tx *sql.Tx, query string, args ...interface{}) string {
+	rows := dbQ(tx.Query, query, args...)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	var parent string
+	if rows.Next() {
+		rows.Scan(&parent)
+	}
+	return parent
+}
+
+// hasAncestor follows the parents of uuid up to the root, or to a cycle.
+func hasAncestor(uuid string, ancestor string, parentOf func(string) string) bool {
+	seen := make(map[string]bool)
+	for uuid = parentOf(uuid); uuid != "" && !seen[uuid]; uuid = parentOf(uuid) {
+		if uuid == ancestor {
+			return true
+		}
+		seen[uuid] = true
+	}
+	return false
+}
+
+// mergedHeaderUUID follows the merges of a header and returns the header
+// that took it over, or the header itself.
+func mergedHeaderUUID(tx *sql.Tx, uuid string) string {
+	seen := make(map[string]bool)
+	for uuid != "" && !seen[uuid] {
+		seen[uuid] = true
+		rows := dbQ(tx.Query, `select into_uuid from header_merges where from_uuid = ?`, uuid)
+		next := ""
+		if rows.Next() {
+			rows.Scan(&next)
+		}
+		checkDBErr(rows)
+		rows.Close()
+		if next == "" {
+			break
+		}
+		uuid = next
+	}
+	return uuid
+}
+
+func headerByUUID(tx *sql.Tx, uuid string) (h headerRef, found bool) {
+	rows := dbQ(tx.Query, `select header_id, header_uuid, header, coalesce(handle,''), coalesce(active,0) from headers
+	where header_uuid = ?`, uuid)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if rows.Next() {
+		rows.Scan(&h.id, &h.uuid, &h.header, &h.handle, &h.active)
+		found = true
+	}
+	return
+}
+
+// redirectMerge applies a merge fetched from elsewhere to what is still
+// referring to the old header here. The revisions are kept: the time server
+// redirects its records the same way.
+func redirectMerge(tx *sql.Tx, m JSONMerge) {
+	from, found := headerByUUID(tx, m.FromUUID)
+	if !found {
+		return
+	}
+	into, found := headerByUUID(tx, mergedHeaderUUID(tx, m.IntoUUID))
+	if !found || into.id == from.id {
+		return
+	}
+	_ = dbX(tx.Exec, `update entries set header_id = ? where header_id = ?`, into.id, from.id)
+	_ = dbX(tx.Exec, `update log set header_uuid = ? where header_uuid = ?`, into.uuid, from.uuid)
+	if from.handle != "" && into.handle != "" {
+		_ = dbX(tx.Exec, `update todo set handle = ? where handle = ?`, into.handle, from.handle)
+	}
+	if !isBelow(tx, into.uuid, from.uuid) {
+		_ = dbX(tx.Exec, `update headers set parent_uuid = ? where parent_uuid = ? and header_id <> ?`,
+			into.uuid, from.uuid, into.id)
+	}
+	_ = dbX(tx.Exec, `update headers set active = 0 where header_id = ?`, from.id)
+}
+
+// splitHeaderTitle returns the levels of a title A:B:C.
+func splitHeaderTitle(title string) []string {
+	parts := make([]string, 0, 3)
+	for _, p := range strings.Split(title, ":") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// pathUUID gives a header created as parent of others the same UUID on every
+// machine, so that the parents do not show up twice after a sync.
+func pathUUID(parentUUID string, title string) string {
+	sum := sha1.Sum([]byte(parentUUID + "\x00" + title))
+	return strings.Trim(base64.URLEncoding.EncodeToString(sum[:16]), "=")
+}
+
+// pathHeader finds the header with this title below the parent (or at the top
+// for an empty parentUUID) and creates it when missing.
+func pathHeader(tx *sql.Tx, parentUUID string, title string) string {
+	rows := dbQ(tx.Query, `select header_uuid from headers where header = ? and coalesce(parent_uuid,'') = ?
+	order by active desc, header_id`, title, parentUUID)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if rows.Next() {
+		var uuid string
+		rows.Scan(&uuid)
+		return uuid
+	}
+	uuid := pathUUID(parentUUID, title)
+	if _, found := headerByUUID(tx, uuid); found {
+		uuid = newUUID() // renamed or moved since
+	}
+	now := time.Now()
+	_ = dbX(tx.Exec, `insert into headers (header_uuid, header, parent_uuid, creation_date, update_date, active)
+	values (?, ?, nullif(?,''), ?, ?, 1)`, uuid, title, parentUUID, now, now)
+	_ = dbX(tx.Exec, `delete from tombstones where object_uuid = ?`, uuid)
+	return uuid
+}
+
+// headerPath returns the title of a header with the titles of its parents, A:B:C.
+func headerPath(tx *sql.Tx, id RowId) string {
+	rows := dbQ(tx.Query, `select coalesce(t.path, h.header) from headers h
+	left join header_tree t on t.header_id = h.header_id
+	where h.header_id = ?`, id)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	var path string
+	if rows.Next() {
+		rows.Scan(&path)
+	}
+	return path
+}
+
+// splitHeaderTitles turns the sub-header naming A:B:C of older versions into
+// parent links: the header is called C, its parent B and that one's parent A.
+func splitHeaderTitles(tx *sql.Tx) {
+	type titled struct {
+		id    RowId
+		title string
+	}
+	headers := make([]titled, 0)
+	// the shorter paths first, A:B is split before A:B:C looks for it
+	rows := dbQ(tx.Query, `select header_id, header from headers
+	where header like '%:%' and parent_uuid is null
+	order by length(header) - length(replace(header, ':', '')), header_id`)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	for rows.Next() {
+		var h titled
+		rows.Scan(&h.id, &h.title)
+		headers = append(headers, h)
+	}
+	moved := 0
+	for _, h := range headers {
+		parts := splitHeaderTitle(h.title)
+		if len(parts) < 2 {
+			continue
+		}
+		parentUUID := ""
+		for _, part := range parts[:len(parts)-1] {
+			parentUUID = pathHeader(tx, parentUUID, part)
+		}
+		_ = dbX(tx.Exec, `update headers set header = ?, parent_uuid = ?, revision = null, update_date = ? where header_id = ?`,
+			parts[len(parts)-1], parentUUID, time.Now(), h.id)
+		moved++
+	}
+	if moved > 0 {
+		fmt.Printf("Moved %d headers below their parent headers\n", moved)
+	}
+}
+
+// headerAttrs are the billing attributes of a header. Unset values are
+// empty, the client, billable, rate and currency are inherited from the parents.
+type headerAttrs struct {
+	client   string
+	billable *bool
+	rate     float64
+	currency string
+	budget   time.Duration
+}
+
+func (a headerAttrs) String() string {
+	parts := make([]string, 0, 5)
+	if a.client != "" {
+		parts = append(parts, "client: "+a.client)
+	}
+	if a.billable != nil {
+		if *a.billable {
+			parts = append(parts, "billable")
+		} else {
+			parts = append(parts, "not billable")
+		}
+	}
+	if a.rate != 0 {
+		rate := fmt.Sprintf("rate: %.2f", a.rate)
+		if a.currency != "" {
+			rate += " " + a.currency
+		}
+		parts = append(parts, rate+"/h")
+	} else if a.currency != "" {
+		parts = append(parts, "currency: "+a.currency)
+	}
+	if a.budget != 0 {
+		parts = append(parts, "budget: "+formatDuration(a.budget))
+	}
+	if len(parts) == 0 {
+		return "no attributes"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// inherit fills the unset attributes from the parent.
+func (a headerAttrs) inherit(parent headerAttrs) headerAttrs {
+	if a.client == "" {
+		a.client = parent.client
+	}
+	if a.billable == nil {
+		a.billable = parent.billable
+	}
+	if a.rate == 0 {
+		a.rate, a.currency = parent.rate, parent.currency
+	} else if a.currency == "" {
+		a.currency = parent.currency
+	}
+	return a
+}
+
+func getHeaderAttrs(tx *sql.Tx, id RowId) headerAttrs {
+	var a headerAttrs
+	var budget int64
+	rows := dbQ(tx.Query, `select coalesce(client,''), billable, coalesce(rate,0), coalesce(currency,''), coalesce(budget,0)
+	from headers where header_id = ?`, id)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if rows.Next() {
+		rows.Scan(&a.client, &a.billable, &a.rate, &a.currency, &budget)
+	}
+	a.budget = time.Duration(budget) * time.Second
+	return a
+}
+
+// parseBudget reads a budget as duration (40h, 90m) or as number of hours.
+func parseBudget(value string) (time.Duration, error) {
+	if hours, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(hours * float64(time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// SetHeaderAttributes sets the attributes given as key=value (client, billable,
+// rate, currency, budget), an empty value unsets one. Without assignments
+// the attributes are shown.
+func SetHeaderAttributes(tx *sql.Tx, ref string, assignments []string) error {
+	h, err := findHeaderRef(tx, ref)
+	if err != nil {
+		return err
+	}
+	a := getHeaderAttrs(tx, h.id)
+	for _, assignment := range assignments {
+		kv := strings.SplitN(assignment, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Expected key=value, not '%s'", assignment)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		switch key {
+		case "client":
+			a.client = value
+		case "billable":
+			if value == "" {
+				a.billable = nil
+				continue
+			}
+			var billable bool
+			switch strings.ToLower(value) {
+			case "true", "yes", "y", "1":
+				billable = true
+			case "false", "no", "n", "0":
+				billable = false
+			default:
+				return fmt.Errorf("billable is yes or no, not '%s'", value)
+			}
+			a.billable = &billable
+		case "rate":
+			a.rate = 0
+			if value != "" {
+				if a.rate, err = strconv.ParseFloat(value, 64); err != nil || a.rate < 0 {
+					return fmt.Errorf("Not a valid rate: '%s'", value)
+				}
+			}
+		case "currency":
+			a.currency = strings.ToUpper(value)
+		case "budget":
+			a.budget = 0
+			if value != "" {
+				if a.budget, err = parseBudget(value); err != nil || a.budget < 0 {
+					return fmt.Errorf("Not a valid budget: '%s' (e.g. 40h)", value)
+				}
+			}
+		default:
+			return fmt.Errorf("Unknown attribute '%s' (client, billable, rate, currency, budget)", key)
+		}
+	}
+	if len(assignments) > 0 {
+		_ = dbX(tx.Exec, `update headers set client = nullif(?,''), billable = ?, rate = nullif(?,0), currency = nullif(?,''),
+		budget = nullif(?,0), revision = null, update_date = ? where header_id = ?`,
+			a.client, a.billable, a.rate, a.currency, int64(a.budget/time.Second), time.Now(), h.id)
+	}
+	fmt.Printf("%s: %s\n", h, a)
+	return nil
+}
@@ -0,0 +1,119 @@
+package tools
+
+import (
+	"database/sql"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The time entries as iCalendar (RFC 5545), to be shown next to the
+// planned meetings in a calendar. Every entry is one VEVENT, running
+// entries end now.
+
+const icsTimeFormat = "20060102T150405Z"
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icsLine folds a content line into lines of at most 75 octets,
+// without splitting UTF-8 characters.
+func icsLine(line string) string {
+	var b strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74 // the leading space counts
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func icsTime(t time.Time) string {
+	return t.UTC().Format(icsTimeFormat)
+}
+
+type icsEntry struct {
+	uuid       string
+	headerUUID string
+	header     string
+	handle     string
+	start      time.Time
+	end        *time.Time
+}
+
+// entryLogs returns the log lines written during the entry.
+func entryLogs(db *sql.DB, e icsEntry, end time.Time) []string {
+	rows := dbQ(db.Query, `select log_text from log
+	where creation_date between ? and ?
+	and (header_uuid is null or header_uuid = ?)
+	order by creation_date`, e.start, end, e.headerUUID)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	logs := make([]string, 0)
+	for rows.Next() {
+		var text string
+		rows.Scan(&text)
+		logs = append(logs, text)
+	}
+	return logs
+}
+
+func ExportICS(db *sql.DB, w io.Writer, from, to time.Time, filter string) error {
+	rows := dbQ(db.Query, `select coalesce(e.entry_uuid, e.entry_id), coalesce(h.header_uuid,''), coalesce(t.path, h.header),
+	coalesce(h.handle,''), e.start, e.end
+	from entries e
+	join headers h on h.header_id = e.header_id
+	left join header_tree t on t.header_id = h.header_id
+	where e.start between ? and ?
+	and lower(coalesce(t.path, h.header)) like lower('%'||?||'%')
+	order by e.start`, from, to, filter)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	entries := make([]icsEntry, 0, 16)
+	for rows.Next() {
+		var e icsEntry
+		rows.Scan(&e.uuid, &e.headerUUID, &e.header, &e.handle, &e.start, &e.end)
+		entries = append(entries, e)
+	}
+
+	now := time.Now()
+	var b strings.Builder
+	b.WriteString(icsLine("BEGIN:VCALENDAR"))
+	b.WriteString(icsLine("VERSION:2.0"))
+	b.WriteString(icsLine("PRODID:-//jramb//punch//EN"))
+	b.WriteString(icsLine("X-WR-CALNAME:punch"))
+	for _, e := range entries {
+		end := now
+		if e.end != nil {
+			end = *e.end
+		}
+		summary := e.header
+		if e.handle != "" {
+			summary += " @" + e.handle
+		}
+		b.WriteString(icsLine("BEGIN:VEVENT"))
+		b.WriteString(icsLine("UID:" + e.uuid + "@punch"))
+		b.WriteString(icsLine("DTSTAMP:" + icsTime(now)))
+		b.WriteString(icsLine("DTSTART:" + icsTime(e.start)))
+		b.WriteString(icsLine("DTEND:" + icsTime(end)))
+		b.WriteString(icsLine("SUMMARY:" + icsEscaper.Replace(summary)))
+		if logs := entryLogs(db, e, end); len(logs) > 0 {
+			b.WriteString(icsLine("DESCRIPTION:" + icsEscaper.Replace(strings.Join(logs, "\n"))))
+		}
+		if e.handle != "" {
+			b.WriteString(icsLine("CATEGORIES:" + icsEscaper.Replace(e.handle)))
+		}
+		b.WriteString(icsLine("END:VEVENT"))
+	}
+	b.WriteString(icsLine("END:VCALENDAR"))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,433 @@
+package tools
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Meetings from a calendar (an .ics file) become time entries. Events are
+// mapped to headers by rules like "Standup=@scrum": the part before = is
+// searched in the summary (or with "category:" in the categories), the part
+// after is a handle or part of a header title. Recurring meetings are expanded
+// for the simple rules (daily and weekly), which covers most of them.
+
+type icsEvent struct {
+	uid          string
+	summary      string
+	categories   []string
+	start        time.Time
+	end          time.Time
+	duration     time.Duration
+	hasEnd       bool
+	allDay       bool
+	cancelled    bool
+	rrule        map[string]string
+	exdates      []time.Time
+	recurrenceID *time.Time
+}
+
+type icsMapping struct {
+	rule     string
+	pattern  string
+	category bool
+	hdr      RowId
+	header   string
+	handle   string
+}
+
+var icsDurationRE = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+var icsUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, `;`, `\,`, `,`, `\n`, "\n", `\N`, "\n")
+
+// icsProperty splits a content line into name, parameters and value.
+func icsProperty(line string) (name string, params map[string]string, value string) {
+	params = make(map[string]string)
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return strings.ToUpper(line), params, ""
+	}
+	parts := strings.Split(line[:colon], ";")
+	for _, p := range parts[1:] {
+		if kv := strings.SplitN(p, "=", 2); len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, line[colon+1:]
+}
+
+// icsParseTime understands UTC (…Z), local times with TZID and floating
+// times, which are taken as local. Dates without time are all-day.
+func icsParseTime(value string, params map[string]string) (t time.Time, allDay bool, err error) {
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err = time.ParseInLocation("20060102", value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse(icsTimeFormat, value)
+		return t.Local(), false, err
+	}
+	loc := time.Local
+	if tzid := params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+func icsParseDuration(value string) (time.Duration, error) {
+	m := icsDurationRE.FindStringSubmatch(value)
+	if m == nil || value == "P" || value == "PT" {
+		return 0, fmt.Errorf("Invalid duration %s", value)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if m[i+2] != "" {
+			n, _ := strconv.Atoi(m[i+2])
+			d += time.Duration(n) * unit
+		}
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// parseICS reads the events of an iCalendar file, folded lines are joined.
+func parseICS(r io.Reader) ([]icsEvent, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lines := make([]string, 0, 256)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || strings.ToUpper(lines[0]) != "BEGIN:VCALENDAR" {
+		return nil, errors.New("Not an iCalendar file")
+	}
+
+	events := make([]icsEvent, 0, 64)
+	var e *icsEvent
+	nested := 0 // components inside the event, e.g. VALARM
+	for _, line := range lines {
+		name, params, value := icsProperty(line)
+		switch {
+		case name == "BEGIN" && strings.ToUpper(value) == "VEVENT":
+			e = &icsEvent{}
+		case e == nil:
+		case name == "BEGIN":
+			nested++
+		case name == "END" && nested > 0:
+			nested--
+		case nested > 0:
+		case name == "END":
+			if !e.hasEnd {
+				e.end = e.start.Add(e.duration)
+			}
+			events = append(events, *e)
+			e = nil
+		case name == "UID":
+			e.uid = value
+		case name == "SUMMARY":
+			e.summary = icsUnescaper.Replace(value)
+		case name == "CATEGORIES":
+			for _, c := range strings.Split(value, ",") {
+				e.categories = append(e.categories, icsUnescaper.Replace(strings.TrimSpace(c)))
+			}
+		case name == "STATUS":
+			e.cancelled = strings.ToUpper(value) == "CANCELLED"
+		case name == "DTSTART":
+			t, allDay, err := icsParseTime(value, params)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid DTSTART %s", value)
+			}
+			e.start, e.allDay = t, allDay
+		case name == "DTEND":
+			t, _, err := icsParseTime(value, params)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid DTEND %s", value)
+			}
+			e.end, e.hasEnd = t, true
+		case name == "DURATION":
+			d, err := icsParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			e.duration = d
+		case name == "RRULE":
+			e.rrule = make(map[string]string)
+			for _, p := range strings.Split(value, ";") {
+				if kv := strings.SplitN(p, "=", 2); len(kv) == 2 {
+					e.rrule[strings.ToUpper(kv[0])] = strings.ToUpper(kv[1])
+				}
+			}
+		case name == "EXDATE":
+			for _, v := range strings.Split(value, ",") {
+				if t, _, err := icsParseTime(v, params); err == nil {
+					e.exdates = append(e.exdates, t)
+				}
+			}
+		case name == "RECURRENCE-ID":
+			if t, _, err := icsParseTime(value, params); err == nil {
+				e.recurrenceID = &t
+			}
+		}
+	}
+	return events, nil
+}
+
+// recurrences returns the starts of a recurring event before 'to'.
+// Only FREQ=DAILY and WEEKLY (with BYDAY, INTERVAL, COUNT and UNTIL) are known.
+func recurrences(e icsEvent, to time.Time) ([]time.Time, error) {
+	interval := 1
+	if i, err := strconv.Atoi(e.rrule["INTERVAL"]); err == nil && i > 0 {
+		interval = i
+	}
+	count := -1
+	if c, err := strconv.Atoi(e.rrule["COUNT"]); err == nil {
+		count = c
+	}
+	until := to
+	if u := e.rrule["UNTIL"]; u != "" {
+		t, allDay, err := icsParseTime(u, map[string]string{"TZID": e.start.Location().String()})
+		if err != nil {
+			return nil, fmt.Errorf("Invalid UNTIL %s", u)
+		}
+		if allDay {
+			t = t.AddDate(0, 0, 1)
+		} else {
+			t = t.Add(time.Second) // UNTIL is inclusive
+		}
+		if t.Before(until) {
+			until = t
+		}
+	}
+	var days []time.Weekday
+	for _, d := range strings.Split(e.rrule["BYDAY"], ",") {
+		if wd, ok := icsWeekdays[d]; ok {
+			days = append(days, wd)
+		}
+	}
+	starts := make([]time.Time, 0, 16)
+	switch e.rrule["FREQ"] {
+	case "DAILY":
+		for t := e.start; t.Before(until) && count != 0; t = t.AddDate(0, 0, interval) {
+			starts = append(starts, t)
+			count--
+		}
+	case "WEEKLY":
+		if len(days) == 0 {
+			days = []time.Weekday{e.start.Weekday()}
+		}
+		monday := e.start.AddDate(0, 0, -((int(e.start.Weekday()) + 6) % 7))
+		for week := monday; week.Before(until) && count != 0; week = week.AddDate(0, 0, 7*interval) {
+			inWeek := make([]time.Time, 0, len(days))
+			for _, wd := range days {
+				inWeek = append(inWeek, week.AddDate(0, 0, (int(wd)+6)%7))
+			}
+			sort.Slice(inWeek, func(i, j int) bool { return inWeek[i].Before(inWeek[j]) })
+			for _, t := range inWeek {
+				if t.Before(e.start) || !t.Before(until) || count == 0 {
+					continue
+				}
+				starts = append(starts, t)
+				count--
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Recurrence %s is not supported", e.rrule["FREQ"])
+	}
+	return starts, nil
+}
+
+// icsOccurrences expands the recurring events and returns all events
+// starting in from--to, ordered by start and in local time (as the entries
+// are stored). Unsupported recurrences are reported and skipped.
+func icsOccurrences(events []icsEvent, from, to time.Time) []icsEvent {
+	moved := make(map[string][]time.Time) // instances given separately, by UID
+	for _, e := range events {
+		if e.recurrenceID != nil {
+			moved[e.uid] = append(moved[e.uid], *e.recurrenceID)
+		}
+	}
+	excluded := func(t time.Time, list []time.Time) bool {
+		for _, x := range list {
+			if x.Equal(t) {
+				return true
+			}
+		}
+		return false
+	}
+	result := make([]icsEvent, 0, len(events))
+	for _, e := range events {
+		if e.rrule == nil || e.recurrenceID != nil {
+			if !e.start.Before(from) && e.start.Before(to) {
+				e.start, e.end = e.start.Local(), e.end.Local()
+				result = append(result, e)
+			}
+			continue
+		}
+		starts, err := recurrences(e, to)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", e.summary, err)
+			continue
+		}
+		length := e.end.Sub(e.start)
+		for _, t := range starts {
+			if t.Before(from) || excluded(t, e.exdates) || excluded(t, moved[e.uid]) {
+				continue
+			}
+			o := e
+			o.start, o.end, o.rrule = t.Local(), t.Add(length).Local(), nil
+			result = append(result, o)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].start.Before(result[j].start) })
+	return result
+}
+
+// parseICSMapping reads a rule "pattern=@handle" or "category:pattern=header".
+func parseICSMapping(rule string) (icsMapping, error) {
+	eq := strings.LastIndex(rule, "=")
+	if eq <= 0 || eq == len(rule)-1 {
+		return icsMapping{}, fmt.Errorf("Invalid mapping '%s', use Pattern=@handle or Pattern=header", rule)
+	}
+	m := icsMapping{rule: rule, pattern: strings.ToLower(strings.TrimSpace(rule[:eq]))}
+	if strings.HasPrefix(m.pattern, "category:") {
+		m.category = true
+		m.pattern = strings.TrimPrefix(m.pattern, "category:")
+	}
+	target := strings.TrimSpace(rule[eq+1:])
+	if strings.HasPrefix(target, "@") {
+		m.handle = target[1:]
+	} else {
+		m.header = target
+	}
+	return m, nil
+}
+
+func (m icsMapping) matches(e icsEvent) bool {
+	if !m.category {
+		return strings.Contains(strings.ToLower(e.summary), m.pattern)
+	}
+	for _, c := range e.categories {
+		if strings.Contains(strings.ToLower(c), m.pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportICS adds the meetings of an iCalendar file in from--to as entries.
+// The first matching mapping rule decides the header, events without one are
+// skipped, as are those not over yet, already present or overlapping other entries.
+// With dryRun nothing is changed, only shown.
+func ImportICS(tx *sql.Tx, r io.Reader, from, to time.Time, rules []string, dryRun bool, effectiveTimeNow time.Time) error {
+	if len(rules) == 0 {
+		return errors.New("No mapping rules, use --map or ics.map in the config")
+	}
+	mappings := make([]icsMapping, 0, len(rules))
+	for _, rule := range rules {
+		m, err := parseICSMapping(rule)
+		if err != nil {
+			return err
+		}
+		if m.hdr, m.header, err = findHeader(tx, m.header, m.handle); err != nil {
+			if m.handle != "" {
+				err = fmt.Errorf("No header with handle @%s", m.handle)
+			}
+			return fmt.Errorf("Mapping '%s': %s", rule, err)
+		}
+		mappings = append(mappings, m)
+	}
+	events, err := parseICS(r)
+	if err != nil {
+		return err
+	}
+
+	var added, unmapped, present, overlapping, skipped int
+	planned := make([]icsEvent, 0) // in a dry run, to find overlaps among the new entries
+	for _, e := range icsOccurrences(events, from, to) {
+		if e.cancelled || e.allDay || !e.end.After(e.start) || e.end.After(effectiveTimeNow) {
+			skipped++
+			continue
+		}
+		var m *icsMapping
+		for i := range mappings {
+			if mappings[i].matches(e) {
+				m = &mappings[i]
+				break
+			}
+		}
+		when := fmt.Sprintf("%s -- %s", e.start.Format(shortDateTime), e.end.Format(timeFormat))
+		if m == nil {
+			fmt.Printf("Not mapped: %s  %s\n", when, e.summary)
+			unmapped++
+			continue
+		}
+		if entryExists(tx, m.hdr, &e.start) {
+			present++
+			continue
+		}
+		err := checkOverlap(tx, RowId(0), e.start, &e.end, effectiveTimeNow)
+		for _, p := range planned {
+			if err == nil && p.start.Before(e.end) && p.end.After(e.start) {
+				err = fmt.Errorf("Overlaps with %s", p.summary)
+			}
+		}
+		if err == nil && !dryRun {
+			_, err = insertEntry(tx, m.hdr, e.start, e.end, effectiveTimeNow)
+		}
+		if err != nil {
+			fmt.Printf("Skipped: %s  %s: %s\n", when, e.summary, err)
+			overlapping++
+			continue
+		}
+		added++
+		if dryRun {
+			planned = append(planned, e)
+			fmt.Printf("Would add %s  %s  (%s)\n", when, formatHeader(m.header, m.handle), e.summary)
+		} else {
+			fmt.Printf("Added %s  %s  (%s)\n", when, formatHeader(m.header, m.handle), e.summary)
+		}
+	}
+	if dryRun {
+		fmt.Printf("Dry run, would import %d entries", added)
+	} else {
+		fmt.Printf("Imported %d entries", added)
+	}
+	fmt.Printf(", %d already present, %d overlapping, %d not mapped, %d ignored (all-day, cancelled or not over)\n",
+		present, overlapping, unmapped, skipped)
+	return nil
+}
@@ -0,0 +1,403 @@
+package tools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// Punch talks MQTT under <mqtt.topic-prefix>/<mqtt.username>: the current
+// state is published (retained, as JSON) to .../state whenever the running
+// entry changes, and 'p mqtt listen' executes the commands sent to .../cmd,
+// e.g. "in @dev", "switch @meet" or "out". The listener tells if it is
+// connected in .../availability ("online", the last will is "offline").
+
+// MQTTState is the payload of the state topic, durations are in seconds.
+type MQTTState struct {
+	State   string     `json:"state"` // on or off
+	Handle  string     `json:"handle,omitempty"`
+	Header  string     `json:"header,omitempty"`
+	Start   *time.Time `json:"start,omitempty"`
+	Elapsed int64      `json:"elapsed"` // of the running entry
+	Today   int64      `json:"today"`   // tracked today, including the running entry
+	Updated time.Time  `json:"updated"`
+}
+
+func mqttTopic(name string) string {
+	return viper.GetString("mqtt.topic-prefix") + "/" + viper.GetString("mqtt.username") + "/" + name
+}
+
+func mqttQoS() (byte, error) {
+	qos := viper.GetInt("mqtt.qos")
+	if qos < 0 || qos > 2 {
+		return 0, fmt.Errorf("mqtt.qos must be 0, 1 or 2, not %d", qos)
+	}
+	return byte(qos), nil
+}
+
+// mqttTLSConfig returns the TLS settings, nil if none are configured
+// (an ssl:// or tls:// broker then uses the system certificates).
+func mqttTLSConfig() (*tls.Config, error) {
+	caFile := viper.GetString("mqtt.tls-ca")
+	certFile := viper.GetString("mqtt.tls-cert")
+	keyFile := viper.GetString("mqtt.tls-key")
+	insecure := viper.GetBool("mqtt.tls-insecure")
+	if caFile == "" && certFile == "" && keyFile == "" && !insecure {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// mqttOptions returns the client options from the config, the suffix keeps
+// the client ID of a long running client apart from the one of 'p in'.
+func mqttOptions(clientIDSuffix string) (*MQTT.ClientOptions, error) {
+	opts := MQTT.NewClientOptions().
+		AddBroker(viper.GetString("mqtt.broker")).
+		SetClientID(viper.GetString("mqtt.client-id") + clientIDSuffix).
+		SetUsername(viper.GetString("mqtt.username")).
+		SetPassword(viper.GetString("mqtt.password")).
+		SetConnectTimeout(5 * time.Second)
+	config, err := mqttTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		opts.SetTLSConfig(config)
+	}
+	return opts, nil
+}
+
+// runningKey identifies the running entries, to notice when they change.
+func runningKey(db *sql.DB) string {
+	rows := dbQ(db.Query, `select e.entry_id, e.header_id, e.start from entries e where e.end is null order by e.entry_id`)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	var key strings.Builder
+	for rows.Next() {
+		var id, hdr int64
+		var start time.Time
+		rows.Scan(&id, &hdr, &start)
+		fmt.Fprintf(&key, "%d/%d/%d;", id, hdr, start.Unix())
+	}
+	return key.String()
+}
+
+func currentState(db *sql.DB) (MQTTState, error) {
+	now := time.Now()
+	state := MQTTState{State: "off", Updated: now}
+	tx, err := db.Begin()
+	if err != nil {
+		return state, err
+	}
+	defer tx.Rollback()
+	running := RunningEntries(tx, now)
+	if len(running) > 0 {
+		r := running[0]
+		state.State, state.Handle, state.Header, state.Start = "on", r.Handle, r.Header, &r.Start
+		if r.Duration > 0 { // the start is rounded, it can be a bit ahead
+			state.Elapsed = r.Duration
+		}
+	}
+	from, to, _ := DecodeTimeFrame("today")
+	days, err := QueryDays(db, from, to, "", 0, 0)
+	if err != nil {
+		return state, err
+	}
+	for _, day := range days {
+		state.Today += day.Duration
+	}
+	for _, r := range running {
+		start := r.Start
+		if start.Before(from) {
+			start = from
+		}
+		if now.After(start) {
+			state.Today += int64(now.Sub(start) / time.Second)
+		}
+	}
+	return state, nil
+}
+
+func publishState(c MQTT.Client, db *sql.DB) error {
+	qos, err := mqttQoS()
+	if err != nil {
+		return err
+	}
+	state, err := currentState(db)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	topic := mqttTopic("state")
+	token := c.Publish(topic, qos, true, payload)
+	token.Wait()
+	d(fmt.Sprintf("Sent '%s' to %s\n", payload, topic))
+	return token.Error()
+}
+
+// publishDiscovery announces the state as Home Assistant sensors (and a
+// button to punch out), if mqtt.discovery is set.
+func publishDiscovery(c MQTT.Client) error {
+	if !viper.GetBool("mqtt.discovery") {
+		return nil
+	}
+	prefix := viper.GetString("mqtt.discovery-prefix")
+	if prefix == "" {
+		prefix = "homeassistant"
+	}
+	user := viper.GetString("mqtt.username")
+	id := "punch_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, user)
+	device := map[string]interface{}{
+		"identifiers": []string{id},
+		"name":        "Punch " + user,
+		"model":       "p",
+	}
+	components := []struct {
+		component, object string
+		config            map[string]interface{}
+	}{
+		{"sensor", "state", map[string]interface{}{
+			"name":                  "Punched in",
+			"state_topic":           mqttTopic("state"),
+			"value_template":        "{{ value_json.handle or value_json.header if value_json.state == 'on' else 'off' }}",
+			"json_attributes_topic": mqttTopic("state"),
+			"icon":                  "mdi:timer-outline",
+		}},
+		{"sensor", "today", map[string]interface{}{
+			"name":                "Tracked today",
+			"state_topic":         mqttTopic("state"),
+			"value_template":      "{{ (value_json.today / 3600) | round(2) }}",
+			"unit_of_measurement": "h",
+			"device_class":        "duration",
+			"icon":                "mdi:clock-outline",
+		}},
+		{"binary_sensor", "listener", map[string]interface{}{
+			"name":         "Listener",
+			"state_topic":  mqttTopic("availability"),
+			"payload_on":   "online",
+			"payload_off":  "offline",
+			"device_class": "connectivity",
+		}},
+		{"button", "out", map[string]interface{}{
+			"name":          "Punch out",
+			"command_topic": mqttTopic("cmd"),
+			"payload_press": "out",
+			"icon":          "mdi:timer-off-outline",
+		}},
+	}
+	for _, comp := range components {
+		comp.config["unique_id"] = id + "_" + comp.object
+		comp.config["device"] = device
+		payload, err := json.Marshal(comp.config)
+		if err != nil {
+			return err
+		}
+		token := c.Publish(fmt.Sprintf("%s/%s/%s/%s/config", prefix, comp.component, id, comp.object), 1, true, payload)
+		if token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+	}
+	return nil
+}
+
+// PublishMQTT sends the current state (and the discovery config) to the
+// broker, if one is configured.
+func PublishMQTT(db *sql.DB, discovery bool) error {
+	if viper.GetString("mqtt.broker") == "" {
+		return nil
+	}
+	opts, err := mqttOptions("")
+	if err != nil {
+		return err
+	}
+	c := MQTT.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	defer c.Disconnect(250)
+	if discovery {
+		if err := publishDiscovery(c); err != nil {
+			return err
+		}
+	}
+	return publishState(c, db)
+}
+
+// publishIfChanged publishes the state if the running entries are not
+// those of before any more. Failing is not fatal, the punch is done anyway.
+func publishIfChanged(db *sql.DB, before string) {
+	if viper.GetString("mqtt.broker") == "" || runningKey(db) == before {
+		return
+	}
+	if err := PublishMQTT(db, false); err != nil {
+		fmt.Fprintln(os.Stderr, "MQTT:", err)
+	}
+}
+
+// mqttCommand punches like the command line does: "in @handle",
+// "switch @handle" (or part of a header instead of the handle) and "out".
+func mqttCommand(payload string) error {
+	argv := strings.Fields(payload)
+	if len(argv) == 0 {
+		return errors.New("Empty command")
+	}
+	command := strings.ToLower(argv[0])
+	handle, args := ParseHandle(argv[1:])
+	effectiveTimeNow := time.Now().Round(time.Minute)
+	return WithTransaction(func(db *sql.DB, tx *sql.Tx) error {
+		switch command {
+		case "in", "switch":
+			handle, err := VerifyHandle(db, handle, false)
+			if err != nil {
+				return err
+			}
+			if handle == "" && len(args) == 0 {
+				return fmt.Errorf("%s needs a handle or header", command)
+			}
+			if command == "switch" {
+				return ChangeCheckIn(tx, []string{strings.Join(args, " ")}, handle, effectiveTimeNow)
+			}
+			if err := CloseAll(tx, effectiveTimeNow); err != nil {
+				return err
+			}
+			return CheckIn(tx, []string{strings.Join(args, " ")}, handle, effectiveTimeNow)
+		case "out":
+			return CloseAll(tx, effectiveTimeNow)
+		default:
+			return fmt.Errorf("Unknown command '%s', use in, switch or out", command)
+		}
+	})
+}
+
+// ListenMQTT executes the commands sent to .../cmd until SIGINT or SIGTERM.
+// Commands are executed one after the other in the order they arrive. The
+// state is published again every mqtt.interval (default 1m) to keep the
+// elapsed times current.
+func ListenMQTT() error {
+	if viper.GetString("mqtt.broker") == "" {
+		return errors.New("No MQTT broker configured (mqtt.broker)")
+	}
+	qos, err := mqttQoS()
+	if err != nil {
+		return err
+	}
+	interval := viper.GetDuration("mqtt.interval")
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	topic := mqttTopic("cmd")
+	availability := mqttTopic("availability")
+	commands := make(chan string, 16)
+	connected := make(chan bool, 1)
+	opts, err := mqttOptions("-listen")
+	if err != nil {
+		return err
+	}
+	opts.SetAutoReconnect(true).
+		SetWill(availability, "offline", qos, true).
+		SetOnConnectHandler(func(c MQTT.Client) {
+			// subscribe again after a reconnect, the session is not kept
+			token := c.Subscribe(topic, qos, func(c MQTT.Client, msg MQTT.Message) {
+				if msg.Retained() {
+					// would punch again after every reconnect, clear it
+					log.Printf("MQTT: ignoring retained command %q", msg.Payload())
+					c.Publish(topic, qos, true, "")
+					return
+				}
+				if len(msg.Payload()) > 0 {
+					commands <- string(msg.Payload())
+				}
+			})
+			if token.Wait() && token.Error() != nil {
+				log.Printf("MQTT: subscribing to %s failed: %s", topic, token.Error())
+				return
+			}
+			c.Publish(availability, qos, true, "online").Wait()
+			log.Printf("MQTT: listening on %s", topic)
+			select {
+			case connected <- true:
+			default:
+			}
+		}).
+		SetConnectionLostHandler(func(c MQTT.Client, err error) {
+			log.Printf("MQTT: connection lost: %s", err)
+		})
+	c := MQTT.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	defer func() {
+		c.Publish(availability, qos, true, "offline").Wait()
+		c.Disconnect(250)
+	}()
+
+	publish := func() {
+		err := WithOpenDB(true, func(db *sql.DB) error {
+			return publishState(c, db)
+		})
+		if err != nil {
+			log.Printf("MQTT: publishing the state failed: %s", err)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case <-connected:
+			if err := publishDiscovery(c); err != nil {
+				log.Printf("MQTT: publishing the discovery config failed: %s", err)
+			}
+			publish()
+		case cmd := <-commands:
+			log.Printf("MQTT: %s", cmd)
+			if err := mqttCommand(cmd); err != nil {
+				log.Printf("MQTT: %s failed: %s", cmd, err)
+			}
+		case <-ticker.C:
+			publish()
+		case <-stop:
+			return nil
+		}
+	}
+}
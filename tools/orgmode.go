@@ -2,8 +2,10 @@ package tools
 
 import (
 	"bufio"
+	"database/sql"
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -60,3 +62,108 @@ func LoadOrgFile(clockfile string, c chan orgEntry) {
 		c <- entry
 	}
 }
+
+var orgTagsRE = regexp.MustCompile(`\s+(:[[:alnum:]_@#%]+)+:\s*$`)
+
+// orgHeaderTitle maps the nested org headers to the sub-header path A:B:C,
+// AddHeader creates the parent headers from it.
+func orgHeaderTitle(path []string) string {
+	parts := make([]string, 0, len(path))
+	for _, p := range path {
+		p = strings.TrimSpace(orgTagsRE.ReplaceAllString(p, ""))
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ":")
+}
+
+func findHeaderByTitle(tx *sql.Tx, title string) RowId {
+	rows := dbQ(tx.Query, `select header_id from header_tree where path = ?`, title)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	var hdrID int64
+	if rows.Next() {
+		rows.Scan(&hdrID)
+	}
+	return RowId(hdrID)
+}
+
+func entryExists(tx *sql.Tx, hdr RowId, start *time.Time) bool {
+	rows := dbQ(tx.Query, `select 1 from entries where header_id = ? and start = ?`, hdr, start)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	return rows.Next()
+}
+
+// ImportOrgFile reads the CLOCK entries of an Emacs org-mode file.
+// Headers are matched by title (nested headers as A:B:C) and created when missing,
+// entries already present (same header and start) are skipped, so the import can be repeated.
+// With dryRun nothing is changed, only shown.
+func ImportOrgFile(tx *sql.Tx, orgfile string, dryRun bool) error {
+	if _, err := os.Stat(orgfile); err != nil {
+		return err
+	}
+	var path []string
+	var title string
+	var hdr RowId
+	created := make(map[string]RowId) // new headers, 0 in a dry run
+	var added, skipped, open int
+	c := make(chan orgEntry)
+	go LoadOrgFile(orgfile, c)
+	for entry := range c {
+		switch entry.lType {
+		case header:
+			for len(path) < entry.deep-1 {
+				path = append(path, "")
+			}
+			path = append(path[:entry.deep-1], entry.header)
+			title = orgHeaderTitle(path)
+			hdr = RowId(0)
+		case clock:
+			if title == "" {
+				fmt.Fprintf(os.Stderr, "Ignoring clock outside of any header: %s\n", entry.text)
+				continue
+			}
+			if entry.end == nil {
+				open++
+				continue
+			}
+			if hdr == 0 {
+				var seen bool
+				if hdr, seen = created[title]; !seen {
+					hdr = findHeaderByTitle(tx, title)
+				}
+				if hdr == 0 && !seen {
+					if dryRun {
+						fmt.Printf("Would create header %s\n", title)
+					} else {
+						var err error
+						if hdr, err = AddHeader(tx, title, "", ""); err != nil {
+							return err
+						}
+					}
+					created[title] = hdr
+				}
+			}
+			if hdr != 0 && entryExists(tx, hdr, entry.start) {
+				skipped++
+				continue
+			}
+			added++
+			if dryRun {
+				fmt.Printf("Would add %s -- %s  %s\n",
+					entry.start.Format(shortDateTime), entry.end.Format(shortDateTime), title)
+			} else {
+				addTime(tx, entry, hdr)
+			}
+		}
+	}
+	if dryRun {
+		fmt.Printf("Dry run, would import %d headers and %d entries", len(created), added)
+	} else {
+		fmt.Printf("Imported %d headers and %d entries", len(created), added)
+	}
+	fmt.Printf(", %d already present, %d open clocks ignored\n", skipped, open)
+	return nil
+}
@@ -0,0 +1,167 @@
+package tools
+
+import (
+	"database/sql"
+	"time"
+)
+
+// The queries in here return structured results instead of printing,
+// they are used by the punch server. Headers are given with their path A:B:C.
+
+type RunningEntry struct {
+	Id       RowId
+	Header   string
+	Handle   string
+	Start    time.Time
+	Duration int64 // seconds until effectiveTimeNow
+}
+
+type HeaderInfo struct {
+	Id      RowId
+	Header  string
+	Handle  string
+	Entries int
+}
+
+type TodoItem struct {
+	Id           int
+	Title        string
+	Handle       string
+	CreationDate time.Time
+}
+
+type LogItem struct {
+	CreationDate time.Time
+	Text         string
+	Handle       string
+}
+
+func RunningEntries(tx *sql.Tx, effectiveTimeNow time.Time) []RunningEntry {
+	rows := dbQ(tx.Query, `select e.entry_id, coalesce(t.path, h.header), coalesce(h.handle,''), e.start
+	from entries e
+	join headers h on h.header_id = e.header_id
+	left join header_tree t on t.header_id = h.header_id
+	where e.end is null
+	order by e.start`)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	running := make([]RunningEntry, 0, 1)
+	for rows.Next() {
+		var r RunningEntry
+		rows.Scan(&r.Id, &r.Header, &r.Handle, &r.Start)
+		r.Duration = int64(effectiveTimeNow.Sub(r.Start) / time.Second)
+		running = append(running, r)
+	}
+	return running
+}
+
+func QueryHeaders(tx *sql.Tx, filter string) []HeaderInfo {
+	rows := dbQ(tx.Query, `select h.header_id, coalesce(t.path, h.header) path, coalesce(h.handle,'')
+	, (select count(*) from entries e where e.header_id = h.header_id) cnt
+	from headers h
+	left join header_tree t on t.header_id = h.header_id
+	where h.active = 1
+	and lower(coalesce(t.path, h.header)) like lower('%'||?||'%')
+	order by path`, filter)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	headers := make([]HeaderInfo, 0, 10)
+	for rows.Next() {
+		var h HeaderInfo
+		rows.Scan(&h.Id, &h.Header, &h.Handle, &h.Entries)
+		headers = append(headers, h)
+	}
+	return headers
+}
+
+// RecentHeaders returns the headers most recently punched into.
+func RecentHeaders(tx *sql.Tx, limit int) []HeaderInfo {
+	rows := dbQ(tx.Query, `select h.header_id, coalesce(t.path, h.header) path, coalesce(h.handle,''), count(*) cnt
+	from headers h
+	join entries e on e.header_id = h.header_id
+	left join header_tree t on t.header_id = h.header_id
+	where h.active = 1
+	group by h.header_id, path, h.handle
+	order by max(e.start) desc
+	limit ?`, limit)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	headers := make([]HeaderInfo, 0, limit)
+	for rows.Next() {
+		var h HeaderInfo
+		rows.Scan(&h.Id, &h.Header, &h.Handle, &h.Entries)
+		headers = append(headers, h)
+	}
+	return headers
+}
+
+// QueryTodos returns the open TODOs of the handle (all open TODOs if handle is empty).
+func QueryTodos(tx *sql.Tx, handle string) []TodoItem {
+	rows := dbQ(tx.Query, `select todo_id, handle, title, creation_date
+	from todo
+	where done_date is null
+	and (?1 = '' or handle = ?1)
+	order by creation_date asc`, handle)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	todos := make([]TodoItem, 0, 10)
+	for rows.Next() {
+		var t TodoItem
+		rows.Scan(&t.Id, &t.Handle, &t.Title, &t.CreationDate)
+		todos = append(todos, t)
+	}
+	return todos
+}
+
+func QueryLogs(tx *sql.Tx, from, to time.Time) []LogItem {
+	rows := dbQ(tx.Query, `select l.creation_date, l.log_text, coalesce(h.handle,'')
+	from log l
+	left join headers h on h.header_uuid = l.header_uuid
+	where l.creation_date between ? and ?
+	order by l.creation_date asc`, from, to)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	logs := make([]LogItem, 0, 10)
+	for rows.Next() {
+		var l LogItem
+		rows.Scan(&l.CreationDate, &l.Text, &l.Handle)
+		logs = append(logs, l)
+	}
+	return logs
+}
+
+// NewTodos returns the TODOs added after the TODO number after.
+func NewTodos(tx *sql.Tx, after int) []TodoItem {
+	rows := dbQ(tx.Query, `select todo_id, handle, title, creation_date
+	from todo
+	where todo_id > ?
+	order by todo_id`, after)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	todos := make([]TodoItem, 0)
+	for rows.Next() {
+		var t TodoItem
+		rows.Scan(&t.Id, &t.Handle, &t.Title, &t.CreationDate)
+		todos = append(todos, t)
+	}
+	return todos
+}
+
+// NewLogs returns the log entries added after rowid after, and the last rowid.
+func NewLogs(tx *sql.Tx, after int64) ([]LogItem, int64) {
+	rows := dbQ(tx.Query, `select l.rowid, l.creation_date, l.log_text, coalesce(h.handle,'')
+	from log l
+	left join headers h on h.header_uuid = l.header_uuid
+	where l.rowid > ?
+	order by l.rowid`, after)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	logs := make([]LogItem, 0)
+	last := after
+	for rows.Next() {
+		var l LogItem
+		rows.Scan(&last, &l.CreationDate, &l.Text, &l.Handle)
+		logs = append(logs, l)
+	}
+	return logs, last
+}
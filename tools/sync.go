@@ -0,0 +1,225 @@
+package tools
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/rpc/json"
+	"github.com/spf13/viper"
+)
+
+// The client side of 'p sync': local changes are those with revision null,
+// they are sent to the time server, which answers with everything new since
+// the last revision we have seen.
+
+func contactTimeServer(args *SyncArgs, timeout time.Duration) (*SyncReply, error) {
+	rpcURL := viper.GetString("timeserver.rpcurl")
+	if rpcURL == "" {
+		return nil, errors.New("Time server not configured (timeserver.rpcurl)")
+	}
+	message, err := json.EncodeClientRequest("T.Sync", args)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", rpcURL, bytes.NewBuffer(message))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if args.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+args.Key)
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Time server: %s", resp.Status)
+	}
+
+	var result SyncReply
+	err = json.DecodeClientResponse(resp.Body, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Sync sends the uncommitted changes to the time server and applies its reply.
+// A timeout of 0 waits for the server as long as it takes. With dryRun the server
+// does not store anything, the caller is expected to roll back tx.
+func Sync(tx *sql.Tx, timeout time.Duration, dryRun bool) (*SyncArgs, *SyncReply, error) {
+	args := GetUncommitted(tx)
+	args.Owner = viper.GetString("timeserver.owner")
+	args.Key = viper.GetString("timeserver.key")
+	args.Revision = GetParamInt(tx, "revision", 0)
+	args.DryRun = dryRun
+
+	reply, err := contactTimeServer(args, timeout)
+	if err != nil {
+		return args, nil, err
+	}
+
+	if reply.Revision > 0 {
+		if err := ApplyUpdates(tx, reply); err != nil {
+			return args, reply, err
+		}
+
+		if err := CommitRevision(tx, reply.Revision); err != nil {
+			return args, reply, err
+		}
+
+		SetParamInt(tx, "revision", reply.Revision)
+	}
+	return args, reply, nil
+}
+
+func PrintConflicts(reply *SyncReply) {
+	for _, c := range reply.Conflicts {
+		fmt.Printf("Conflict on %s %s: %s version kept\n", c.Type, c.Description, c.Winner)
+	}
+}
+
+func hasUncommitted(tx *sql.Tx) bool {
+	rows := dbQ(tx.Query, `select 1 from headers where revision is null
+	union all select 1 from entries where revision is null
+	union all select 1 from log where revision is null
+	union all select 1 from todo where revision is null
+	union all select 1 from tombstones where revision is null
+	union all select 1 from header_merges where revision is null
+	limit 1`)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	return rows.Next()
+}
+
+// autoSync runs after a committed transaction when timeserver.autosync is set.
+// If the time server can not be reached within timeserver.autosync-timeout
+// the changes simply stay uncommitted and go with the next (auto)sync.
+func autoSync(db *sql.DB) {
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Autosync:", err)
+		return
+	}
+	defer RollbackOnError(tx)
+	if !hasUncommitted(tx) {
+		return
+	}
+	timeout := viper.GetDuration("timeserver.autosync-timeout")
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	args, reply, err := Sync(tx, timeout, false)
+	if err != nil {
+		tx.Rollback()
+		fmt.Fprintln(os.Stderr, "Autosync failed, changes will be sent later:", err)
+		return
+	}
+	d(fmt.Sprintf("Autosync revision %d, pushed %d entries, fetched %d entries",
+		reply.Revision, len(*args.Entries), len(reply.Entries)))
+	PrintConflicts(reply)
+}
+
+// SyncStatus shows the time server setup and what the next sync would send.
+func SyncStatus(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rpcURL := viper.GetString("timeserver.rpcurl")
+	if rpcURL == "" {
+		rpcURL = "(not configured)"
+	}
+	autosync := "off"
+	if viper.GetBool("timeserver.autosync") {
+		autosync = "on"
+	}
+	fmt.Printf("Time server: %s, owner: %s, autosync: %s\n", rpcURL, viper.GetString("timeserver.owner"), autosync)
+	fmt.Println("Last synced revision:", GetParamInt(tx, "revision", 0))
+
+	pending := 0
+	rh := dbQ(tx.Query, `select header, coalesce(handle,'') from headers where revision is null order by header_id`)
+	defer rh.Close()
+	defer checkDBErr(rh)
+	for rh.Next() {
+		var header, handle string
+		rh.Scan(&header, &handle)
+		fmt.Println("header:", formatHeader(header, handle))
+		pending++
+	}
+	re := dbQ(tx.Query, `select e.entry_id, h.header, coalesce(h.handle,''), e.start, e.end
+	from entries e
+	join headers h on h.header_id = e.header_id
+	where e.revision is null
+	order by e.start`)
+	defer re.Close()
+	defer checkDBErr(re)
+	for re.Next() {
+		var e EntryInfo
+		re.Scan(&e.Id, &e.Header, &e.Handle, &e.Start, &e.End)
+		fmt.Println("entry:", e)
+		pending++
+	}
+	rl := dbQ(tx.Query, `select creation_date, log_text from log where revision is null order by creation_date`)
+	defer rl.Close()
+	defer checkDBErr(rl)
+	for rl.Next() {
+		var created time.Time
+		var text string
+		rl.Scan(&created, &text)
+		fmt.Println("log:", created.Format(shortDateTime), text)
+		pending++
+	}
+	rt := dbQ(tx.Query, `select title, coalesce(handle,''), done_date is not null from todo where revision is null order by todo_id`)
+	defer rt.Close()
+	defer checkDBErr(rt)
+	for rt.Next() {
+		var title, handle string
+		var done bool
+		rt.Scan(&title, &handle, &done)
+		if done {
+			title += " (done)"
+		}
+		fmt.Println("todo:", formatHeader(title, handle))
+		pending++
+	}
+	rd := dbQ(tx.Query, `select object_type, object_uuid, deletion_date from tombstones where revision is null order by deletion_date`)
+	defer rd.Close()
+	defer checkDBErr(rd)
+	for rd.Next() {
+		var objectType, uuid string
+		var deleted time.Time
+		rd.Scan(&objectType, &uuid, &deleted)
+		fmt.Printf("deleted: %s %s (%s)\n", objectType, uuid, deleted.Format(shortDateTime))
+		pending++
+	}
+	rm := dbQ(tx.Query, `select coalesce(f.header, m.from_uuid), coalesce(i.header, m.into_uuid) from header_merges m
+	left join headers f on f.header_uuid = m.from_uuid
+	left join headers i on i.header_uuid = m.into_uuid
+	where m.revision is null order by m.merge_date`)
+	defer rm.Close()
+	defer checkDBErr(rm)
+	for rm.Next() {
+		var from, into string
+		rm.Scan(&from, &into)
+		fmt.Printf("merge: %s into %s\n", from, into)
+		pending++
+	}
+	if pending == 0 {
+		fmt.Println("Nothing to send.")
+	} else {
+		fmt.Printf("%d changes to send.\n", pending)
+	}
+	return nil
+}
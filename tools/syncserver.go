@@ -0,0 +1,534 @@
+package tools
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// The time server keeps the synchronized data of all owners in its own database.
+// Every sync that pushes changes creates a new revision for that owner,
+// clients fetch everything newer than the revision they have seen last.
+
+func OpenServerDB() (*sql.DB, error) {
+	dbfile := viper.GetString("server.database")
+	if dbfile == "" {
+		return nil, errors.New("Server database not configured (server.database)")
+	}
+	d("server database=" + dbfile)
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // SQLite does not like concurrent writers
+	return db, nil
+}
+
+// ErrDryRun makes WithServerTransaction roll back without reporting an error.
+var ErrDryRun = errors.New("dry run")
+
+// WithServerTransaction runs fn in a transaction which is committed if fn succeeds.
+// Other than WithTransaction a panic is returned as an error, so that a failing
+// request does not take down the server.
+func WithServerTransaction(db *sql.DB, fn func(*sql.Tx) error) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		if err == ErrDryRun {
+			tx.Rollback()
+			err = nil
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	return fn(tx)
+}
+
+func PrepareServerDB(tx *sql.Tx) error {
+	_ = dbX(tx.Exec, `create table if not exists params
+	(param text,value text, primary key (param))`)
+
+	dbVersion := GetParamInt(tx, "version", 0)
+	currentVersion := 6
+
+	if dbVersion > currentVersion {
+		return fmt.Errorf("This code is for an older version than your server database: code %d, db %d", currentVersion, dbVersion)
+	}
+
+	_ = dbX(tx.Exec, `create table if not exists sync_owners
+	( owner text primary key
+	, revision int not null
+	)`)
+	_ = dbX(tx.Exec, `create table if not exists sync_headers
+	( owner text not null
+	, header_uuid text not null
+	, revision int not null
+	, header text
+	, handle text
+	, active boolean
+	, creation_date datetime
+	, primary key (owner, header_uuid)
+	)`)
+	_ = dbX(tx.Exec, `create table if not exists sync_entries
+	( owner text not null
+	, entry_uuid text not null
+	, revision int not null
+	, header_uuid text
+	, start datetime
+	, end datetime
+	, primary key (owner, entry_uuid)
+	)`)
+	_ = dbX(tx.Exec, `create table if not exists sync_logs
+	( owner text not null
+	, log_uuid text not null
+	, revision int not null
+	, creation_date datetime
+	, log_text text
+	, header_uuid text
+	, primary key (owner, log_uuid)
+	)`)
+	_ = dbX(tx.Exec, `create table if not exists sync_todos
+	( owner text not null
+	, todo_uuid text not null
+	, revision int not null
+	, title text
+	, handle text
+	, creation_date datetime
+	, done_date datetime
+	, primary key (owner, todo_uuid)
+	)`)
+	_ = dbX(tx.Exec, `create table if not exists sync_tombstones
+	( owner text not null
+	, object_uuid text not null
+	, object_type text not null
+	, revision int not null
+	, deletion_date datetime
+	, primary key (owner, object_uuid)
+	)`)
+	_ = dbX(tx.Exec, `create index if not exists sync_headers_n1 on sync_headers (owner, revision)`)
+	_ = dbX(tx.Exec, `create index if not exists sync_entries_n1 on sync_entries (owner, revision)`)
+	_ = dbX(tx.Exec, `create index if not exists sync_logs_n1 on sync_logs (owner, revision)`)
+	_ = dbX(tx.Exec, `create index if not exists sync_todos_n1 on sync_todos (owner, revision)`)
+	_ = dbX(tx.Exec, `create index if not exists sync_tombstones_n1 on sync_tombstones (owner, revision)`)
+
+	if dbVersion < 2 {
+		_ = dbX(tx.Exec, `alter table sync_headers add update_date datetime`)
+		_ = dbX(tx.Exec, `alter table sync_entries add update_date datetime`)
+		_ = dbX(tx.Exec, `alter table sync_logs add update_date datetime`)
+		_ = dbX(tx.Exec, `alter table sync_todos add update_date datetime`)
+	}
+
+	if dbVersion < 3 {
+		_ = dbX(tx.Exec, `create table if not exists api_tokens
+		( token_id integer primary key autoincrement
+		, name text not null unique
+		, token_hash text not null unique
+		, scope text not null
+		, owner text
+		, creation_date datetime
+		, last_used datetime
+		)`)
+	}
+
+	if dbVersion < 4 {
+		_ = dbX(tx.Exec, `create table if not exists sync_header_merges
+		( owner text not null
+		, from_uuid text not null
+		, into_uuid text not null
+		, revision int not null
+		, merge_date datetime
+		, primary key (owner, from_uuid)
+		)`)
+	}
+
+	if dbVersion < 5 {
+		_ = dbX(tx.Exec, `alter table sync_headers add parent_uuid text`)
+	}
+
+	if dbVersion < 6 {
+		_ = dbX(tx.Exec, `alter table sync_headers add client text`)
+		_ = dbX(tx.Exec, `alter table sync_headers add billable boolean`)
+		_ = dbX(tx.Exec, `alter table sync_headers add rate real`)
+		_ = dbX(tx.Exec, `alter table sync_headers add currency text`)
+		_ = dbX(tx.Exec, `alter table sync_headers add budget int`)
+	}
+
+	SetParamInt(tx, "version", currentVersion)
+	return nil
+}
+
+// WithServerDB opens and prepares the server database for fn, used by the
+// commands maintaining the server.
+func WithServerDB(fn func(*sql.Tx) error) error {
+	db, err := OpenServerDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := WithServerTransaction(db, PrepareServerDB); err != nil {
+		return err
+	}
+	return WithServerTransaction(db, fn)
+}
+
+func serverRevision(tx *sql.Tx, owner string) int {
+	rows := dbQ(tx.Query, `select revision from sync_owners where owner = ?`, owner)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	revision := 0
+	if rows.Next() {
+		rows.Scan(&revision)
+	}
+	return revision
+}
+
+// ServerRevisions returns the current revision of every owner.
+func ServerRevisions(tx *sql.Tx) map[string]int {
+	rows := dbQ(tx.Query, `select owner, revision from sync_owners`)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	revisions := make(map[string]int)
+	for rows.Next() {
+		var owner string
+		var revision int
+		rows.Scan(&owner, &revision)
+		revisions[owner] = revision
+	}
+	return revisions
+}
+
+// serverMergedHeader follows the merges of a header in the server database.
+func serverMergedHeader(tx *sql.Tx, owner string, uuid string) string {
+	seen := make(map[string]bool)
+	for uuid != "" && !seen[uuid] {
+		seen[uuid] = true
+		rows := dbQ(tx.Query, `select into_uuid from sync_header_merges where owner = ? and from_uuid = ?`, owner, uuid)
+		next := ""
+		if rows.Next() {
+			rows.Scan(&next)
+		}
+		checkDBErr(rows)
+		rows.Close()
+		if next == "" {
+			break
+		}
+		uuid = next
+	}
+	return uuid
+}
+
+// serverRedirectMerge moves the records of a merged header to the header that
+// took it over. They get the new revision, so every client fetches them.
+func serverRedirectMerge(tx *sql.Tx, owner string, revision int, m JSONMerge) {
+	into := serverMergedHeader(tx, owner, m.IntoUUID)
+	_ = dbX(tx.Exec, `update sync_entries set header_uuid = ?3, revision = ?4 where owner = ?1 and header_uuid = ?2`,
+		owner, m.FromUUID, into, revision)
+	_ = dbX(tx.Exec, `update sync_logs set header_uuid = ?3, revision = ?4 where owner = ?1 and header_uuid = ?2`,
+		owner, m.FromUUID, into, revision)
+	below := hasAncestor(into, m.FromUUID, func(uuid string) string {
+		return queryParent(tx, `select coalesce(parent_uuid,'') from sync_headers where owner = ? and header_uuid = ?`,
+			owner, uuid)
+	})
+	if !below { // no cycles
+		_ = dbX(tx.Exec, `update sync_headers set parent_uuid = ?3, revision = ?4
+		where owner = ?1 and parent_uuid = ?2 and header_uuid <> ?3`, owner, m.FromUUID, into, revision)
+	}
+	_, fromHandle := SyncedHeader(tx, owner, m.FromUUID)
+	_, intoHandle := SyncedHeader(tx, owner, into)
+	if fromHandle != "" && intoHandle != "" {
+		_ = dbX(tx.Exec, `update sync_todos set handle = ?3, revision = ?4 where owner = ?1 and handle = ?2`,
+			owner, fromHandle, intoHandle, revision)
+	}
+}
+
+// serverState returns the revision and the time of the last change
+// (or deletion) of a record in the server database.
+func serverState(tx *sql.Tx, owner string, obj syncObject, uuid string) (revision int, modified *time.Time, found bool) {
+	rows := dbQ(tx.Query, fmt.Sprintf(`select revision, update_date from %s where owner = ? and %s = ?`,
+		obj.serverTable, obj.uuidColumn), owner, uuid)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if rows.Next() {
+		rows.Scan(&revision, &modified)
+		found = true
+	}
+	rd := dbQ(tx.Query, `select revision, deletion_date from sync_tombstones where owner = ? and object_uuid = ?`, owner, uuid)
+	defer rd.Close()
+	defer checkDBErr(rd)
+	if rd.Next() {
+		var deleted int
+		var deletionDate *time.Time
+		rd.Scan(&deleted, &deletionDate)
+		if !found || deleted > revision {
+			revision, modified, found = deleted, deletionDate, true
+		}
+	}
+	return
+}
+
+// serverAccepts decides if a pushed change is stored. If the record was changed
+// (or deleted) by another client since the last sync of this client,
+// the newer change wins and the conflict is reported back.
+func serverAccepts(tx *sql.Tx, owner string, since int, reply *SyncReply,
+	objectType string, uuid string, modified *time.Time, description string) bool {
+	obj, ok := syncObjects[objectType]
+	if !ok {
+		d("Ignoring unknown type ", objectType)
+		return false
+	}
+	revision, serverModified, found := serverState(tx, owner, obj, uuid)
+	if !found || revision <= since {
+		return true
+	}
+	clientWins := modified != nil && (serverModified == nil || modified.After(*serverModified))
+	winner := "server"
+	if clientWins {
+		winner = "client"
+	}
+	reply.Conflicts = append(reply.Conflicts, SyncConflict{
+		Type:        objectType,
+		UUID:        uuid,
+		Description: description,
+		Winner:      winner,
+	})
+	return clientWins
+}
+
+// ServerSync stores the changes pushed by a client and returns everything
+// the client has not seen yet (except what it just pushed itself).
+func ServerSync(tx *sql.Tx, args *SyncArgs, reply *SyncReply) error {
+	if args.Owner == "" {
+		return errors.New("Missing owner")
+	}
+	owner := args.Owner
+	revision := serverRevision(tx, owner)
+	since := args.Revision
+	if since > revision {
+		// the client knows more than we do (new server database?), send everything
+		since = 0
+	}
+	reply.Owner = owner
+	reply.Conflicts = make([]SyncConflict, 0)
+	accepted := make(map[string]bool)
+	if args.Pushes() {
+		revision++
+		upsert(tx, `update sync_owners set revision=?2 where owner=?1`,
+			`insert into sync_owners (owner, revision) values (?1, ?2)`,
+			owner, revision)
+	}
+	if args.Headers != nil {
+		for _, h := range *args.Headers {
+			if !serverAccepts(tx, owner, since, reply, "header", h.UUID, h.UpdateDate, h.Header) {
+				continue
+			}
+			upsert(tx, `update sync_headers set revision=?3, header=?4, handle=?5, active=?6, creation_date=?7, update_date=?8,
+				parent_uuid=?9, client=?10, billable=?11, rate=?12, currency=?13, budget=?14
+				where owner=?1 and header_uuid=?2`,
+				`insert into sync_headers (owner, header_uuid, revision, header, handle, active, creation_date, update_date, parent_uuid,
+				client, billable, rate, currency, budget)
+				values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14)`,
+				owner, h.UUID, revision, h.Header, h.Handle, h.Active, h.CreationDate, h.UpdateDate, h.ParentUUID,
+				h.Client, h.Billable, h.Rate, h.Currency, h.Budget)
+			accepted[h.UUID] = true
+		}
+	}
+	if args.Merges != nil {
+		// merges do not conflict, a header merged twice follows the later merge
+		for _, m := range *args.Merges {
+			upsert(tx, `update sync_header_merges set into_uuid=?3, revision=?4, merge_date=?5
+				where owner=?1 and from_uuid=?2`,
+				`insert into sync_header_merges (owner, from_uuid, into_uuid, revision, merge_date)
+				values (?1, ?2, ?3, ?4, ?5)`,
+				owner, m.FromUUID, m.IntoUUID, revision, m.MergeDate)
+			accepted["merge:"+m.FromUUID] = true
+		}
+	}
+	if args.Entries != nil {
+		for _, e := range *args.Entries {
+			e.HeaderUUID = serverMergedHeader(tx, owner, e.HeaderUUID)
+			var description string
+			if e.Start != nil {
+				description = e.Start.Format(shortDateTime)
+			}
+			if !serverAccepts(tx, owner, since, reply, "entry", e.UUID, e.UpdateDate, description) {
+				continue
+			}
+			upsert(tx, `update sync_entries set revision=?3, header_uuid=?4, start=?5, end=?6, update_date=?7
+				where owner=?1 and entry_uuid=?2`,
+				`insert into sync_entries (owner, entry_uuid, revision, header_uuid, start, end, update_date)
+				values (?1, ?2, ?3, ?4, ?5, ?6, ?7)`,
+				owner, e.UUID, revision, e.HeaderUUID, e.Start, e.End, e.UpdateDate)
+			accepted[e.UUID] = true
+		}
+	}
+	if args.Logs != nil {
+		for _, l := range *args.Logs {
+			l.HeaderUUID = serverMergedHeader(tx, owner, l.HeaderUUID)
+			if !serverAccepts(tx, owner, since, reply, "log", l.UUID, l.UpdateDate, l.Text) {
+				continue
+			}
+			upsert(tx, `update sync_logs set revision=?3, creation_date=?4, log_text=?5, header_uuid=?6, update_date=?7
+				where owner=?1 and log_uuid=?2`,
+				`insert into sync_logs (owner, log_uuid, revision, creation_date, log_text, header_uuid, update_date)
+				values (?1, ?2, ?3, ?4, ?5, ?6, ?7)`,
+				owner, l.UUID, revision, l.CreationDate, l.Text, l.HeaderUUID, l.UpdateDate)
+			accepted[l.UUID] = true
+		}
+	}
+	if args.Todos != nil {
+		for _, t := range *args.Todos {
+			if !serverAccepts(tx, owner, since, reply, "todo", t.UUID, t.UpdateDate, t.Title) {
+				continue
+			}
+			upsert(tx, `update sync_todos set revision=?3, title=?4, handle=?5, creation_date=?6, done_date=?7, update_date=?8
+				where owner=?1 and todo_uuid=?2`,
+				`insert into sync_todos (owner, todo_uuid, revision, title, handle, creation_date, done_date, update_date)
+				values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)`,
+				owner, t.UUID, revision, t.Title, t.Handle, t.CreationDate, t.DoneDate, t.UpdateDate)
+			accepted[t.UUID] = true
+		}
+	}
+	for uuid := range accepted {
+		// a record changed after its deletion elsewhere is alive again
+		_ = dbX(tx.Exec, `delete from sync_tombstones where owner = ? and object_uuid = ?`, owner, uuid)
+	}
+	if args.Deleted != nil {
+		for _, t := range *args.Deleted {
+			if !serverAccepts(tx, owner, since, reply, t.Type, t.UUID, t.DeletionDate, "(deletion)") {
+				continue
+			}
+			obj := syncObjects[t.Type]
+			if t.Type == "header" {
+				// the entries of the header are deleted with it, on every client
+				_ = dbX(tx.Exec, `insert or replace into sync_tombstones (owner, object_uuid, object_type, revision, deletion_date)
+				select owner, entry_uuid, 'entry', ?3, ?4 from sync_entries where owner = ?1 and header_uuid = ?2`,
+					owner, t.UUID, revision, t.DeletionDate)
+				_ = dbX(tx.Exec, `delete from sync_entries where owner = ? and header_uuid = ?`, owner, t.UUID)
+			}
+			_ = dbX(tx.Exec, fmt.Sprintf(`delete from %s where owner = ? and %s = ?`, obj.serverTable, obj.uuidColumn),
+				owner, t.UUID)
+			upsert(tx, `update sync_tombstones set object_type=?3, revision=?4, deletion_date=?5
+				where owner=?1 and object_uuid=?2`,
+				`insert into sync_tombstones (owner, object_uuid, object_type, revision, deletion_date)
+				values (?1, ?2, ?3, ?4, ?5)`,
+				owner, t.UUID, t.Type, revision, t.DeletionDate)
+			accepted[t.UUID] = true
+		}
+	}
+	if args.Merges != nil {
+		for _, m := range *args.Merges {
+			serverRedirectMerge(tx, owner, revision, m)
+		}
+	}
+
+	reply.Revision = revision
+	reply.Headers = make([]JSONHeader, 0)
+	reply.Entries = make([]JSONEntry, 0)
+	reply.Logs = make([]JSONLog, 0)
+	reply.Todos = make([]JSONTodo, 0)
+	reply.Deleted = make([]JSONTombstone, 0)
+	reply.Merges = make([]JSONMerge, 0)
+	rh := dbQ(tx.Query, `select header_uuid, revision, header, handle, coalesce(parent_uuid,''), active, creation_date, update_date,
+	coalesce(client,''), billable, coalesce(rate,0), coalesce(currency,''), coalesce(budget,0)
+	from sync_headers
+	where owner = ? and revision > ?
+	order by revision`, owner, since)
+	defer rh.Close()
+	defer checkDBErr(rh)
+	for rh.Next() {
+		h := JSONHeader{}
+		rh.Scan(&h.UUID, &h.Revision, &h.Header, &h.Handle, &h.ParentUUID, &h.Active, &h.CreationDate, &h.UpdateDate,
+			&h.Client, &h.Billable, &h.Rate, &h.Currency, &h.Budget)
+		if !accepted[h.UUID] {
+			reply.Headers = append(reply.Headers, h)
+		}
+	}
+	re := dbQ(tx.Query, `select entry_uuid, revision, header_uuid, start, end, update_date
+	from sync_entries
+	where owner = ? and revision > ?
+	order by revision`, owner, since)
+	defer re.Close()
+	defer checkDBErr(re)
+	for re.Next() {
+		e := JSONEntry{}
+		re.Scan(&e.UUID, &e.Revision, &e.HeaderUUID, &e.Start, &e.End, &e.UpdateDate)
+		if !accepted[e.UUID] {
+			reply.Entries = append(reply.Entries, e)
+		}
+	}
+	rl := dbQ(tx.Query, `select log_uuid, revision, creation_date, log_text, header_uuid, update_date
+	from sync_logs
+	where owner = ? and revision > ?
+	order by revision`, owner, since)
+	defer rl.Close()
+	defer checkDBErr(rl)
+	for rl.Next() {
+		l := JSONLog{}
+		rl.Scan(&l.UUID, &l.Revision, &l.CreationDate, &l.Text, &l.HeaderUUID, &l.UpdateDate)
+		if !accepted[l.UUID] {
+			reply.Logs = append(reply.Logs, l)
+		}
+	}
+	rt := dbQ(tx.Query, `select todo_uuid, revision, title, handle, creation_date, done_date, update_date
+	from sync_todos
+	where owner = ? and revision > ?
+	order by revision`, owner, since)
+	defer rt.Close()
+	defer checkDBErr(rt)
+	for rt.Next() {
+		t := JSONTodo{}
+		rt.Scan(&t.UUID, &t.Revision, &t.Title, &t.Handle, &t.CreationDate, &t.DoneDate, &t.UpdateDate)
+		if !accepted[t.UUID] {
+			reply.Todos = append(reply.Todos, t)
+		}
+	}
+	rd := dbQ(tx.Query, `select object_uuid, object_type, revision, deletion_date
+	from sync_tombstones
+	where owner = ? and revision > ?
+	order by revision`, owner, since)
+	defer rd.Close()
+	defer checkDBErr(rd)
+	for rd.Next() {
+		t := JSONTombstone{}
+		rd.Scan(&t.UUID, &t.Type, &t.Revision, &t.DeletionDate)
+		if !accepted[t.UUID] {
+			reply.Deleted = append(reply.Deleted, t)
+		}
+	}
+	rm := dbQ(tx.Query, `select from_uuid, into_uuid, revision, merge_date
+	from sync_header_merges
+	where owner = ? and revision > ?
+	order by revision`, owner, since)
+	defer rm.Close()
+	defer checkDBErr(rm)
+	for rm.Next() {
+		m := JSONMerge{}
+		rm.Scan(&m.FromUUID, &m.IntoUUID, &m.Revision, &m.MergeDate)
+		if !accepted["merge:"+m.FromUUID] {
+			reply.Merges = append(reply.Merges, m)
+		}
+	}
+	return nil
+}
+
+// SyncedHeader returns title and handle of a header in the server database.
+func SyncedHeader(tx *sql.Tx, owner string, uuid string) (header string, handle string) {
+	rows := dbQ(tx.Query, `select coalesce(header,''), coalesce(handle,'') from sync_headers
+	where owner = ? and header_uuid = ?`, owner, uuid)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if rows.Next() {
+		rows.Scan(&header, &handle)
+	}
+	return
+}
@@ -0,0 +1,251 @@
+package tools
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// testServerDB opens an initialized time server database in memory.
+func testServerDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if err := WithServerTransaction(db, PrepareServerDB); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testSync does what Sync does, calling ServerSync on the server database
+// instead of the time server.
+func testSync(t *testing.T, client *sql.DB, server *sql.DB) *SyncReply {
+	reply := &SyncReply{}
+	testTx(t, client, func(tx *sql.Tx) {
+		args := GetUncommitted(tx)
+		args.Owner = "me"
+		args.Revision = GetParamInt(tx, "revision", 0)
+		if err := WithServerTransaction(server, func(stx *sql.Tx) error {
+			return ServerSync(stx, args, reply)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		ApplyUpdates(tx, reply)
+		CommitRevision(tx, reply.Revision)
+		SetParamInt(tx, "revision", reply.Revision)
+	})
+	return reply
+}
+
+// testCount runs a select count(*) query in its own transaction.
+func testCount(t *testing.T, db *sql.DB, query string, args ...interface{}) (n int) {
+	testTx(t, db, func(tx *sql.Tx) { n = count(t, tx, query, args...) })
+	return
+}
+
+func headerUUID(t *testing.T, db *sql.DB, handle string) (uuid string) {
+	testTx(t, db, func(tx *sql.Tx) {
+		tx.QueryRow(`select header_uuid from headers where handle = ?`, handle).Scan(&uuid)
+	})
+	return
+}
+
+func TestSyncHeaderDeletion(t *testing.T) {
+	server, a, b := testServerDB(t), testDB(t), testDB(t)
+	start := time.Date(2016, 10, 3, 9, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	testTx(t, a, func(tx *sql.Tx) {
+		hdr, _ := AddHeader(tx, "Project", "proj", "")
+		addTime(tx, orgEntry{start: &start, end: &end}, hdr)
+	})
+	testSync(t, a, server)
+	testSync(t, b, server)
+	assert(t, testCount(t, b, `select count(*) from entries`) == 1, "the entry is synced")
+
+	uuid := headerUUID(t, a, "proj")
+	testTx(t, a, func(tx *sql.Tx) {
+		// there is no command for it, other versions might delete headers
+		_ = dbX(tx.Exec, `delete from headers where header_uuid = ?`, uuid)
+		addTombstone(tx, "header", uuid)
+	})
+	testSync(t, a, server)
+	assert(t, testCount(t, server, `select count(*) from sync_entries`) == 0, "the server deletes the entries of the header")
+	assert(t, testCount(t, a, `select count(*) from entries`) == 0, "the deleting client gets the entry deletions")
+	testSync(t, b, server)
+	assert(t, testCount(t, b, `select count(*) from headers`) == 0, "the header is deleted")
+	assert(t, testCount(t, b, `select count(*) from entries`) == 0, "no entries are left without a header")
+}
+
+func TestServerSync(t *testing.T) {
+	server, a, b := testServerDB(t), testDB(t), testDB(t)
+	start := time.Date(2016, 10, 3, 9, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	testTx(t, a, func(tx *sql.Tx) {
+		hdr, _ := AddHeader(tx, "Customer:Project", "proj", "")
+		addTime(tx, orgEntry{start: &start, end: &end}, hdr)
+		addTime(tx, orgEntry{start: &end}, hdr)
+		LogEntry(tx, []string{"working"}, end.Add(time.Minute))
+		AddTodo(tx, "call back", "proj", end)
+	})
+	reply := testSync(t, a, server)
+	assert(t, reply.Revision == 1, "the push gets the first revision")
+	assert(t, len(reply.Headers) == 0 && len(reply.Entries) == 0, "the client does not get its own changes back")
+	assert(t, testCount(t, a, `select count(*) from entries where revision is null`) == 0, "the pushed records are committed")
+	assert(t, testCount(t, server, `select count(*) from sync_headers where owner = 'me'`) == 2, "the server has the headers")
+
+	reply = testSync(t, b, server)
+	assert(t, len(reply.Headers) == 2 && len(reply.Entries) == 2 && len(reply.Logs) == 1 && len(reply.Todos) == 1,
+		"another client gets everything")
+	testTx(t, b, func(tx *sql.Tx) {
+		assert(t, headerPath(tx, findHeaderByTitle(tx, "Customer:Project")) == "Customer:Project", "with the parent")
+		assert(t, len(RunningEntries(tx, end.Add(time.Hour))) == 1, "the running entry is synced")
+		assert(t, len(QueryTodos(tx, "proj")) == 1, "the todo is synced")
+	})
+	reply = testSync(t, b, server)
+	assert(t, reply.Revision == 1 && len(reply.Entries) == 0, "nothing new, nothing fetched")
+
+	testTx(t, a, func(tx *sql.Tx) { SetParamInt(tx, "revision", 5) })
+	reply = testSync(t, a, server)
+	assert(t, len(reply.Entries) == 2, "a client ahead of the server gets everything")
+
+	err := WithServerTransaction(server, func(tx *sql.Tx) error {
+		return ServerSync(tx, &SyncArgs{}, &SyncReply{})
+	})
+	assert(t, err != nil, "the owner is required")
+}
+
+// editLast changes the end of the latest entry, the change made at modified.
+func editLast(t *testing.T, db *sql.DB, end string, modified time.Time) {
+	testTx(t, db, func(tx *sql.Tx) {
+		id, _ := FindEntryId(tx, "last")
+		assert(t, EditEntry(tx, id, "", end, "", modified) == nil, "the entry is changed")
+		_ = dbX(tx.Exec, `update entries set update_date = ? where entry_id = ?`, modified, id)
+	})
+}
+
+func lastEnd(t *testing.T, db *sql.DB) (end string) {
+	testTx(t, db, func(tx *sql.Tx) {
+		id, _ := FindEntryId(tx, "last")
+		if e, err := GetEntry(tx, id); err == nil && e.End != nil {
+			end = e.End.Format(timeFormat)
+		}
+	})
+	return
+}
+
+func TestSyncConflicts(t *testing.T) {
+	server, a, b := testServerDB(t), testDB(t), testDB(t)
+	start := time.Date(2016, 10, 3, 9, 0, 0, 0, time.Local)
+	end := start.Add(time.Hour)
+	testTx(t, a, func(tx *sql.Tx) {
+		hdr, _ := AddHeader(tx, "Project", "proj", "")
+		addTime(tx, orgEntry{start: &start, end: &end}, hdr)
+	})
+	testSync(t, a, server)
+	testSync(t, b, server)
+
+	editLast(t, a, "10:30", end.Add(time.Hour))
+	editLast(t, b, "11:00", end.Add(2*time.Hour))
+	reply := testSync(t, a, server)
+	assert(t, len(reply.Conflicts) == 0, "the first change is no conflict")
+	reply = testSync(t, b, server)
+	assert(t, len(reply.Conflicts) == 1 && reply.Conflicts[0].Winner == "client", "the newer change of the client wins")
+	testSync(t, a, server)
+	assert(t, lastEnd(t, a) == "11:00", "the winner reaches the other client")
+
+	editLast(t, a, "11:30", end.Add(4*time.Hour))
+	editLast(t, b, "12:00", end.Add(3*time.Hour))
+	testSync(t, a, server)
+	reply = testSync(t, b, server)
+	assert(t, len(reply.Conflicts) == 1 && reply.Conflicts[0].Winner == "server", "the newer change on the server wins")
+	assert(t, lastEnd(t, b) == "11:30", "the client gets the winner")
+	reply = testSync(t, b, server)
+	assert(t, len(reply.Conflicts) == 0 && len(reply.Entries) == 0, "the conflict is resolved")
+}
+
+func TestSyncDeletions(t *testing.T) {
+	server, a, b := testServerDB(t), testDB(t), testDB(t)
+	start := time.Date(2016, 10, 3, 9, 0, 0, 0, time.Local)
+	end := start.Add(time.Hour)
+	testTx(t, a, func(tx *sql.Tx) {
+		hdr, _ := AddHeader(tx, "Project", "proj", "")
+		addTime(tx, orgEntry{start: &start, end: &end}, hdr)
+		later, laterEnd := end.Add(time.Hour), end.Add(2*time.Hour)
+		addTime(tx, orgEntry{start: &later, end: &laterEnd}, hdr)
+	})
+	testSync(t, a, server)
+	testSync(t, b, server)
+
+	testTx(t, a, func(tx *sql.Tx) {
+		id, _ := FindEntryId(tx, "last")
+		assert(t, DeleteEntry(tx, id) == nil, "the entry is deleted")
+		assert(t, count(t, tx, `select count(*) from tombstones where revision is null`) == 1, "a tombstone is left")
+	})
+	reply := testSync(t, a, server)
+	assert(t, len(reply.Deleted) == 0, "the client does not get its own deletion back")
+	assert(t, testCount(t, server, `select count(*) from sync_entries`) == 1, "the server deletes the entry")
+	reply = testSync(t, b, server)
+	assert(t, len(reply.Deleted) == 1 && reply.Deleted[0].Type == "entry", "the deletion reaches the other client")
+	assert(t, testCount(t, b, `select count(*) from entries`) == 1, "and is applied there")
+	assert(t, testCount(t, b, `select count(*) from tombstones where revision is null`) == 0, "it is not pushed back")
+
+	// a change after the deletion elsewhere brings the entry back
+	testTx(t, a, func(tx *sql.Tx) {
+		id, _ := FindEntryId(tx, "last")
+		DeleteEntry(tx, id)
+		_ = dbX(tx.Exec, `update tombstones set deletion_date = ? where revision is null`, time.Now().Add(-2*time.Hour))
+	})
+	testTx(t, b, func(tx *sql.Tx) {
+		_ = dbX(tx.Exec, `update entries set end = ?, update_date = ?, revision = null`, end.Add(30*time.Minute), time.Now())
+	})
+	testSync(t, a, server)
+	reply = testSync(t, b, server)
+	assert(t, len(reply.Conflicts) == 1 && reply.Conflicts[0].Winner == "client", "the later change wins over the deletion")
+	testSync(t, a, server)
+	assert(t, testCount(t, a, `select count(*) from entries`) == 1, "the entry is back")
+	assert(t, testCount(t, server, `select count(*) from sync_tombstones`) == 1, "only the first deletion remains")
+}
+
+func TestSyncMergeRedirect(t *testing.T) {
+	server, a, b := testServerDB(t), testDB(t), testDB(t)
+	start := time.Date(2016, 10, 3, 9, 0, 0, 0, time.Local)
+	end := start.Add(time.Hour)
+	testTx(t, a, func(tx *sql.Tx) {
+		AddHeader(tx, "Infra old", "old", "")
+		AddHeader(tx, "Infra:Servers", "servers", "")
+		AddHeader(tx, "Sub", "sub", "@old")
+	})
+	testSync(t, a, server)
+	testSync(t, b, server)
+	oldUUID, intoUUID := headerUUID(t, a, "old"), headerUUID(t, a, "servers")
+
+	testTx(t, a, func(tx *sql.Tx) {
+		assert(t, MergeHeaders(tx, "@old", "@servers") == nil, "headers are merged")
+	})
+	// b does not know about the merge yet
+	testTx(t, b, func(tx *sql.Tx) {
+		old, _, _ := findHeader(tx, "", "old")
+		addTime(tx, orgEntry{start: &start, end: &end}, old)
+		LogEntry(tx, []string{"offline"}, start.Add(time.Minute))
+	})
+	testSync(t, a, server)
+	reply := testSync(t, b, server)
+	assert(t, len(reply.Merges) == 1 && reply.Merges[0].IntoUUID == intoUUID, "the merge reaches the other client")
+	assert(t, testCount(t, server, `select count(*) from sync_entries where header_uuid = ?`, intoUUID) == 1,
+		"the server redirects the entry pushed for the old header")
+	assert(t, testCount(t, b, `select count(*) from entries e join headers h on h.header_id = e.header_id
+	where h.header_uuid = ?`, intoUUID) == 1, "the client redirects its entry")
+	assert(t, testCount(t, b, `select count(*) from log where header_uuid = ?`, oldUUID) == 0, "and its log")
+	assert(t, testCount(t, b, `select count(*) from headers where header_uuid = ? and active = 0`, oldUUID) == 1,
+		"the old header is archived")
+	assert(t, testCount(t, b, `select count(*) from headers h join headers p on p.header_uuid = h.parent_uuid
+	where h.handle = 'sub' and p.handle = 'servers'`) == 1, "its sub-header moves along")
+
+	testSync(t, a, server)
+	assert(t, testCount(t, a, `select count(*) from entries e join headers h on h.header_id = e.header_id
+	where h.header_uuid = ?`, intoUUID) == 1, "the redirected entry reaches the merging client")
+	assert(t, testCount(t, a, `select count(*) from log where header_uuid = ?`, intoUUID) == 1, "as does the log")
+}
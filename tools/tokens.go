@@ -0,0 +1,111 @@
+package tools
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// API tokens give access to the punch server. Only a hash of the token
+// is stored, the token itself is shown once when it is created.
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+type APIToken struct {
+	Id           int
+	Name         string
+	Scope        string
+	Owner        string // if set the token can only sync this owner
+	CreationDate time.Time
+	LastUsed     *time.Time
+}
+
+func (t *APIToken) CanWrite() bool {
+	return t.Scope == ScopeWrite
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func AddToken(tx *sql.Tx, name string, scope string, owner string) (string, error) {
+	if name == "" {
+		return "", errors.New("Need a name for the token")
+	}
+	if scope != ScopeRead && scope != ScopeWrite {
+		return "", fmt.Errorf("Scope must be %s or %s, not %s", ScopeRead, ScopeWrite, scope)
+	}
+	rows := dbQ(tx.Query, `select 1 from api_tokens where name = ?`, name)
+	exists := rows.Next()
+	rows.Close()
+	if exists {
+		return "", fmt.Errorf("A token named %s exists already", name)
+	}
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+	_ = dbX(tx.Exec, `insert into api_tokens (name, token_hash, scope, owner, creation_date)
+	values (?, ?, ?, nullif(?,''), ?)`, name, hashToken(token), scope, owner, time.Now())
+	return token, nil
+}
+
+func ListTokens(tx *sql.Tx) error {
+	rows := dbQ(tx.Query, `select token_id, name, scope, coalesce(owner,''), creation_date, last_used
+	from api_tokens order by token_id`)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	for rows.Next() {
+		var t APIToken
+		rows.Scan(&t.Id, &t.Name, &t.Scope, &t.Owner, &t.CreationDate, &t.LastUsed)
+		owner := t.Owner
+		if owner == "" {
+			owner = "*"
+		}
+		lastUsed := "never"
+		if t.LastUsed != nil {
+			lastUsed = t.LastUsed.Format(shortDateTime)
+		}
+		fmt.Printf("[%d] %s  %s  owner: %s  created: %s  last used: %s\n", t.Id, t.Name, t.Scope, owner,
+			t.CreationDate.Format(shortDateTime), lastUsed)
+	}
+	return nil
+}
+
+func RevokeToken(tx *sql.Tx, name string) error {
+	res := dbX(tx.Exec, `delete from api_tokens where name = ?`, name)
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		return fmt.Errorf("No token named %s", name)
+	}
+	fmt.Println("Revoked", name)
+	return nil
+}
+
+// FindToken returns the token, or nil if it is unknown (or revoked).
+func FindToken(tx *sql.Tx, token string) *APIToken {
+	if token == "" {
+		return nil
+	}
+	hash := hashToken(token)
+	rows := dbQ(tx.Query, `select token_id, name, scope, coalesce(owner,''), creation_date, last_used
+	from api_tokens where token_hash = ?`, hash)
+	defer rows.Close()
+	defer checkDBErr(rows)
+	if !rows.Next() {
+		return nil
+	}
+	var t APIToken
+	rows.Scan(&t.Id, &t.Name, &t.Scope, &t.Owner, &t.CreationDate, &t.LastUsed)
+	rows.Close()
+	_ = dbX(tx.Exec, `update api_tokens set last_used = ? where token_id = ?`, time.Now(), t.Id)
+	return &t
+}
@@ -27,7 +27,6 @@ import (
 	// go get github.com/mattn/go-sqlite3
 	_ "github.com/mattn/go-sqlite3"
 	//"github.com/ttacon/chalk"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/jramb/chalk"
 )
 
@@ -114,12 +113,15 @@ func findHeader(tx *sql.Tx, header string, handle string) (hdr RowId, headerText
 	var rows *sql.Rows
 	if handle != "" {
 		d(`Find using handle: `, handle)
-		rows = dbQ(tx.Query, `select rowid, header from headers
-		where handle = ?`, handle)
+		rows = dbQ(tx.Query, `select h.rowid, coalesce(t.path, h.header) from headers h
+		left join header_tree t on t.header_id = h.header_id
+		where h.handle = ? and h.active = 1`, handle)
 	} else {
 		d(`Find using part of title: `, header)
-		rows = dbQ(tx.Query, `select rowid, header from headers
-		where lower(header) like '%'||lower(?)||'%'`, header)
+		rows = dbQ(tx.Query, `select h.rowid, coalesce(t.path, h.header) from headers h
+		left join header_tree t on t.header_id = h.header_id
+		where lower(coalesce(t.path, h.header)) like '%'||lower(?1)||'%' and h.active = 1
+		order by lower(coalesce(t.path, h.header)) = lower(?1) desc`, header)
 	}
 	defer d(`done find header`)
 	errCheck(err, `findHeader`)
@@ -129,8 +131,15 @@ func findHeader(tx *sql.Tx, header string, handle string) (hdr RowId, headerText
 	if rows.Next() {
 		rows.Scan(&hdrID, &headerText)
 		hdr = RowId(hdrID)
+		if strings.EqualFold(headerText, header) {
+			return // the full path, its sub-headers match as well
+		}
 	} else {
-		err = errors.New("Header '" + header + "' not found!")
+		if handle != "" {
+			err = errors.New("Header @" + handle + " not found (or archived)!")
+		} else {
+			err = errors.New("Header '" + header + "' not found!")
+		}
 		hdr = RowId(0)
 	}
 	if rows.Next() {
@@ -149,24 +158,45 @@ func newUUID() string {
 	return strings.Trim(base64.URLEncoding.EncodeToString(u.Bytes()), "=")
 }
 
-func AddHeader(tx *sql.Tx, header string, handle string) (RowId, error) {
+// AddHeader creates a header below parent (a header reference, may be empty).
+// A title A:B:C creates the header C below B and A, which are created as well
+// if they do not exist yet.
+func AddHeader(tx *sql.Tx, header string, handle string, parent string) (RowId, error) {
+	var parentUUID string
+	if parent != "" {
+		p, err := findHeaderRef(tx, parent)
+		if err != nil {
+			return RowId(0), err
+		}
+		parentUUID = p.uuid
+	}
+	parts := splitHeaderTitle(header)
+	if len(parts) == 0 {
+		return RowId(0), errors.New("Need a title for the header")
+	}
+	for _, part := range parts[:len(parts)-1] {
+		parentUUID = pathHeader(tx, parentUUID, part)
+	}
 	headerUUUID := newUUID()
-	res := dbX(tx.Exec, `insert into headers (header_uuid, header, handle, creation_date, active)
-	values(?,?,?,?,1)`,
-		headerUUUID, header, handle, time.Now())
+	res := dbX(tx.Exec, `insert into headers (header_uuid, header, handle, parent_uuid, creation_date, update_date, active)
+	values(?,?,?,nullif(?,''),?,?,1)`,
+		headerUUUID, parts[len(parts)-1], handle, parentUUID, time.Now(), time.Now())
 	rowid, err := res.LastInsertId()
 	if err != nil {
 		return RowId(rowid), err
 	}
-	fmt.Printf("Inserted %s\n", header)
+	fmt.Printf("Inserted %s\n", headerPath(tx, RowId(rowid)))
 	return RowId(rowid), nil
 }
 
-func addTime(tx *sql.Tx, entry orgEntry, headerId RowId) {
+func addTime(tx *sql.Tx, entry orgEntry, headerId RowId) RowId {
 	entryUUID := newUUID()
-	_ = dbX(tx.Exec, `insert into entries (entry_uuid, header_id, start, end) values(?,?,?,?)`,
-		entryUUID, headerId, entry.start, entry.end)
+	res := dbX(tx.Exec, `insert into entries (entry_uuid, header_id, start, end, update_date) values(?,?,?,?,?)`,
+		entryUUID, headerId, entry.start, entry.end, time.Now())
 	//log.Print(fmt.Sprintf("Inserted %s\n", entry))
+	rowid, err := res.LastInsertId()
+	errCheck(err, `fetching LastInsertId`)
+	return RowId(rowid)
 }
 
 func GetTx(db *sql.DB) (*sql.Tx, error) {
@@ -198,29 +228,38 @@ func WithOpenDB(checkExists bool, fn func(*sql.DB) error) error {
 
 func WithTransaction(fn func(*sql.DB, *sql.Tx) error) error {
 	return WithOpenDB(true, func(db *sql.DB) error {
-		tx, err := db.Begin()
-		if err != nil {
-			return err
+		var running string
+		if viper.GetString("mqtt.broker") != "" {
+			running = runningKey(db)
 		}
-		defer RollbackOnError(tx)
-		autoSync := viper.GetBool("timeserver.autosync")
-		if autoSync {
-			//FIXME
-		}
-		r := fn(db, tx)
-		if autoSync {
-			//FIXME
+		r, committed := runTransaction(db, fn)
+		if committed && r == nil {
+			if viper.GetBool("timeserver.autosync") {
+				autoSync(db)
+			}
+			publishIfChanged(db, running)
 		}
 		return r
 	})
 }
 
+// runTransaction commits unless fn panics, committed tells which happened.
+func runTransaction(db *sql.DB, fn func(*sql.DB, *sql.Tx) error) (r error, committed bool) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err, false
+	}
+	defer RollbackOnError(tx)
+	r = fn(db, tx)
+	return r, true
+}
+
 func PrepareDB(db *sql.DB, tx *sql.Tx) error {
 	_ = dbX(tx.Exec, `create table if not exists params
 	(param text,value text, primary key (param))`)
 
 	dbVersion := GetParamInt(tx, "version", 0)
-	currentVersion := 9
+	currentVersion := 13
 
 	if dbVersion > currentVersion {
 		fmt.Printf("This code is for an older version than your database: code %d, db %d\n", currentVersion, dbVersion)
@@ -258,6 +297,11 @@ func PrepareDB(db *sql.DB, tx *sql.Tx) error {
 	, handle text
 	, creation_date datetime not null
   , done_date datetime)`)
+	_ = dbX(tx.Exec, `create table if not exists tombstones
+	( object_uuid text primary key
+	, object_type text not null
+	, revision int
+	, deletion_date datetime not null)`)
 	_ = dbX(tx.Exec, `create unique index if not exists headers_u1 on headers (header_uuid)`)
 	_ = dbX(tx.Exec, `create unique index if not exists entries_u1 on entries (entry_uuid)`)
 	_ = dbX(tx.Exec, `create unique index if not exists log_u1 on log (log_uuid)`)
@@ -267,6 +311,44 @@ func PrepareDB(db *sql.DB, tx *sql.Tx) error {
 	//_ = dbX(tx.Exec, `alter table headers add revision int`)
 	//_ = dbX(tx.Exec, `alter table entries add revision int`)
 	//}
+	if dbVersion < 10 {
+		// last modification, decides sync conflicts
+		_ = dbX(tx.Exec, `alter table headers add update_date datetime`)
+		_ = dbX(tx.Exec, `alter table entries add update_date datetime`)
+		_ = dbX(tx.Exec, `alter table log add update_date datetime`)
+		_ = dbX(tx.Exec, `alter table todo add update_date datetime`)
+	}
+	if dbVersion < 11 {
+		// merged headers, to redirect records synced later
+		_ = dbX(tx.Exec, `create table if not exists header_merges
+		( from_uuid text primary key
+		, into_uuid text not null
+		, revision int
+		, merge_date datetime)`)
+	}
+	if dbVersion < 12 {
+		// sub-headers, header_tree gives the path A:B:C and depth of every header
+		_ = dbX(tx.Exec, `alter table headers add parent_uuid text`)
+		_ = dbX(tx.Exec, `create view if not exists header_tree as
+		with recursive t (header_id, header_uuid, path, depth) as
+		( select header_id, header_uuid, header, 0 from headers
+		  where parent_uuid is null
+		  or parent_uuid not in (select header_uuid from headers where header_uuid is not null)
+		  union all
+		  select h.header_id, h.header_uuid, t.path||':'||h.header, t.depth+1
+		  from headers h join t on h.parent_uuid = t.header_uuid
+		  where t.depth < 20
+		)
+		select header_id, header_uuid, path, depth from t`)
+	}
+	if dbVersion < 13 {
+		// header attributes for billing, the budget in seconds
+		_ = dbX(tx.Exec, `alter table headers add client text`)
+		_ = dbX(tx.Exec, `alter table headers add billable boolean`)
+		_ = dbX(tx.Exec, `alter table headers add rate real`)
+		_ = dbX(tx.Exec, `alter table headers add currency text`)
+		_ = dbX(tx.Exec, `alter table headers add budget int`)
+	}
 
 	SetParamInt(tx, "version", currentVersion)
 	fmt.Println("Initialized database with version", GetParamInt(tx, `version`, 0))
@@ -318,17 +400,19 @@ and 1=(select count(*)
    join headers h on e.header_id = h.header_id
    where log.creation_date>=e.start and (e.end is null or log.creation_date<=e.end))`)
 
+	if dbVersion < 12 {
+		splitHeaderTitles(tx)
+	}
 	return nil
 }
 
 func CloseAll(tx *sql.Tx, effectiveTimeNow time.Time) error {
-	res := dbX(tx.Exec, `update entries set end=?, revision=null where end is null`, effectiveTimeNow)
+	res := dbX(tx.Exec, `update entries set end=?, revision=null, update_date=? where end is null`, effectiveTimeNow, time.Now())
 	updatedCnt, err := res.RowsAffected()
 	errCheck(err, `fetching RowsAffected`)
 	if updatedCnt > 0 {
 		d("Closed entries: ", updatedCnt)
 	}
-	SendMQTT("off")
 	return nil
 }
 
@@ -353,7 +437,7 @@ func modifyOpen(tx *sql.Tx, argv []string, modifyEffectiveTime *time.Duration) {
 		rows.Scan(&start, &rowid)
 		newStart := start.Add(-*modifyEffectiveTime)
 		fmt.Printf("New start: %s (added %s)\n", newStart.Format(timeFormat), *modifyEffectiveTime)
-		_ = dbX(tx.Exec, `update entries set start=?, revision=null where rowid = ?`, newStart, rowid)
+		_ = dbX(tx.Exec, `update entries set start=?, revision=null, update_date=? where rowid = ?`, newStart, time.Now(), rowid)
 	}
 	if cnt == 0 {
 		fmt.Printf(`Nothing open, maybe modify latest entry? [TODO]`)
@@ -365,12 +449,13 @@ func LogEntry(tx *sql.Tx, argv []string, effectiveTimeNow time.Time) error {
 	currentHdr := currentHeader(tx, effectiveTimeNow)
 	if logString != "" {
 		_ = dbX(tx.Exec, `insert into log
-(log_uuid, creation_date, log_text, header_uuid)
-values (?,?,?,?)`,
+(log_uuid, creation_date, log_text, header_uuid, update_date)
+values (?,?,?,?,?)`,
 			newUUID(),
 			effectiveTimeNow,
 			strings.Join(argv, " "),
-			currentHdr)
+			currentHdr,
+			time.Now())
 	}
 	return nil
 }
@@ -415,8 +500,8 @@ func AddTodo(tx *sql.Tx, title string, handle string, effectiveTimeNow time.Time
 	if handle == "" {
 		panic("missing handle, TODOs need a handle")
 	}
-	res := dbX(tx.Exec, `insert into todo(handle,title,creation_date) values(?,?,?)`,
-		handle, title, effectiveTimeNow)
+	res := dbX(tx.Exec, `insert into todo(todo_uuid,handle,title,creation_date,update_date) values(?,?,?,?,?)`,
+		newUUID(), handle, title, effectiveTimeNow, time.Now())
 	todoId, err := res.LastInsertId()
 	if err != nil {
 		return err
@@ -448,7 +533,7 @@ func TodoDone(tx *sql.Tx, argv []string, handle string, effectiveTimeNow time.Ti
 				var title string
 				var creation_date time.Time
 				rows.Scan(&todoId, &handle, &title, &creation_date)
-				_ = dbX(tx.Exec, `update todo set done_date =  ? where todo_id= ?`, effectiveTimeNow, todoId)
+				_ = dbX(tx.Exec, `update todo set done_date = ?, revision = null, update_date = ? where todo_id = ?`, effectiveTimeNow, time.Now(), todoId)
 				fmt.Printf("Done TODO: #%d: %s (@%s)\n", todoId, title, handle)
 			} else {
 				return fmt.Errorf("No valid TODO with this number %d", todoId)
@@ -481,7 +566,7 @@ func TodoUndo(tx *sql.Tx, argv []string, handle string) error {
 				var title string
 				var creation_date time.Time
 				rows.Scan(&todoId, &handle, &title, &creation_date)
-				_ = dbX(tx.Exec, `update todo set done_date =  null where todo_id= ?`, todoId)
+				_ = dbX(tx.Exec, `update todo set done_date = null, revision = null, update_date = ? where todo_id = ?`, time.Now(), todoId)
 				fmt.Printf("Undone TODO: #%d: %s (@%s)\n", todoId, title, handle)
 			} else {
 				return fmt.Errorf("No valid TODO with this number %d", todoId)
@@ -528,65 +613,6 @@ func ShowTodo(db *sql.DB, argv []string, handle string, limit int) error {
 	return nil
 }
 
-func SendMQTT(text string) {
-	//define a function for the default message handler
-	var f MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
-		fmt.Printf("TOPIC: %s\n", msg.Topic())
-		fmt.Printf("MSG: %s\n", msg.Payload())
-	}
-	//create a ClientOptions struct setting the broker address, clientid, turn
-	//off trace output and set the default message handler
-	// opts := MQTT.NewClientOptions().AddBroker("tcp://iot.eclipse.org:1883")
-	broker := viper.GetString("mqtt.broker")
-	if broker == "" {
-		return
-	}
-
-	username := viper.GetString("mqtt.username")
-	topicprefix := viper.GetString("mqtt.topic-prefix") + "/" + username
-	opts := MQTT.NewClientOptions().
-		AddBroker(broker).
-		SetClientID(viper.GetString("mqtt.client-id")).
-		SetUsername(username).
-		SetPassword(viper.GetString("mqtt.password"))
-	opts.SetDefaultPublishHandler(f)
-
-	//create and start a client using the above ClientOptions
-	c := MQTT.NewClient(opts)
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
-		fmt.Println("MQTT: ", token.Error())
-		// panic(token.Error())
-		return
-	}
-
-	//subscribe to the topic /go-mqtt/sample and request messages to be delivered
-	//at a maximum qos of zero, wait for the receipt to confirm the subscription
-	// if token := c.Subscribe(topicprefix+"/sample", 0, nil); token.Wait() && token.Error() != nil {
-	// 	fmt.Println(token.Error())
-	// 	os.Exit(1)
-	// }
-
-	//Publish 5 messages to /go-mqtt/sample at qos 1 and wait for the receipt
-	//from the server after sending each message
-	// for i := 0; i < 3; i++ {
-	// text := fmt.Sprintf("this is msg #%d!", i)
-	topic := topicprefix + "/state"
-	token := c.Publish(topic, 0, false, text)
-	d(fmt.Sprintf("Send '%s' to %s at %s\n", text, topic, broker))
-	token.Wait()
-	// }
-
-	// time.Sleep(3 * time.Second)
-
-	//unsubscribe from /go-mqtt/sample
-	// if token := c.Unsubscribe(topicprefix + "/sample"); token.Wait() && token.Error() != nil {
-	// 	fmt.Println(token.Error())
-	// 	os.Exit(1)
-	// }
-
-	c.Disconnect(250)
-}
-
 func CheckIn(tx *sql.Tx, argv []string, handle string, effectiveTimeNow time.Time) error {
 	var header string
 
@@ -608,9 +634,9 @@ func CheckIn(tx *sql.Tx, argv []string, handle string, effectiveTimeNow time.Tim
 		//end:
 		//duration    time.Duration
 	}
-	SendMQTT(handle)
 	addTime(tx, entry, hdr)
 	fmt.Printf("Checked into %s\n", headerText)
+	warnBudget(tx, hdr)
 	return nil
 }
 
@@ -623,7 +649,6 @@ func ChangeCheckIn(tx *sql.Tx, argv []string, handle string, effectiveTimeNow ti
 		}
 		header = argv[0]
 	}
-	SendMQTT(handle)
 	//log.Println("header to check into: " + header)
 	hdr, headerText, err := findHeader(tx, header, handle)
 	if err != nil {
@@ -633,12 +658,14 @@ func ChangeCheckIn(tx *sql.Tx, argv []string, handle string, effectiveTimeNow ti
 	res := dbX(tx.Exec, `update entries
 set header_id=(select header_id from headers where rowid=?)
 , revision=null
-where end is null`, hdr)
+, update_date=?
+where end is null`, hdr, time.Now())
 	updatedCnt, err := res.RowsAffected()
 	errCheck(err, `fetching RowsAffected`)
 	if updatedCnt > 0 {
 		fmt.Println("Switched to " + headerText)
 		// d("Changed entries: ", updatedCnt)
+		warnBudget(tx, hdr)
 	}
 	return nil
 
@@ -746,33 +773,6 @@ func resetDb(tx *sql.Tx) {
 	_ = dbX(tx.Exec, `delete from headers`)
 }
 
-func importOrgData(tx *sql.Tx, clockfile string) {
-	headerStack := make([]RowId, 0, 10)
-	c := make(chan orgEntry)
-	go LoadOrgFile(clockfile, c)
-	for entry := range c {
-		var err error
-		switch entry.depthChange {
-		case 1:
-			headerStack = append(headerStack, RowId(0))
-		case 0:
-			_ = 0
-		default:
-			headerStack = headerStack[:len(headerStack)+entry.depthChange]
-		}
-		//fmt.Printf("len=%d, headerStack=%+v", len(headerStack), headerStack)
-		switch entry.lType {
-		case header:
-			headerStack[len(headerStack)-1], err = AddHeader(tx, entry.header, "")
-			if err != nil {
-				panic(err)
-			}
-		case clock:
-			addTime(tx, entry, headerStack[len(headerStack)-1])
-		}
-	}
-}
-
 func loadTimeFile(clockfile string,
 	doer func(data orgData, argv []string) orgData,
 	argv []string) {
@@ -792,17 +792,21 @@ func nvl(str *string, alt string) string {
 	}
 	return alt
 }
-func ShowHeaders(db *sql.DB, argv []string) error {
+
+// ShowHeaders lists the active headers, with all also the archived ones.
+func ShowHeaders(db *sql.DB, argv []string, all bool) error {
 	var filter string
 	if len(argv) > 0 {
 		filter = argv[0]
 	}
-	rows := dbQ(db.Query, `select rowid, header
+	rows := dbQ(db.Query, `select rowid, coalesce(t.path, h.header)
 , (select count(*)+7 from entries e where e.header_id=h.header_id) cnt
 , handle
+, coalesce(h.active,0)
 from headers h
-where h.active=1
-and lower(h.header) like lower('%'||?||'%')`, filter)
+left join header_tree t on t.header_id = h.header_id
+where (h.active=1 or ?2)
+and lower(coalesce(t.path, h.header)) like lower('%'||?1||'%')`, filter, all)
 	defer rows.Close()
 	defer checkDBErr(rows)
 	for rows.Next() {
@@ -810,11 +814,16 @@ and lower(h.header) like lower('%'||?||'%')`, filter)
 		var head string
 		var handle *string
 		var count int
-		rows.Scan(&id, &head, &count, &handle)
+		var active bool
+		rows.Scan(&id, &head, &count, &handle, &active)
 
-		fmt.Printf("[%2d] %s  (%d)\n",
+		archived := ""
+		if !active {
+			archived = " (archived)"
+		}
+		fmt.Printf("[%2d] %s  (%d)%s\n",
 			id, // strings.Repeat("   ", depth),
-			formatHeader(head, nvl(handle, "")), count)
+			formatHeader(head, nvl(handle, "")), count, archived)
 	}
 	return nil
 }
@@ -1034,15 +1043,17 @@ func ShowTimes(db *sql.DB, timeFrame string, argv []string) (err error) {
 	if len(argv) > 1 {
 		filter = argv[1]
 	}
+	withSub := viper.GetBool("show.subheaders")
 	rows := dbQ(db.Query, `
-select rowid, header, handle, depth,
+select h.rowid, coalesce(t.path, h.header), coalesce(h.handle,''), coalesce(t.depth, 0),
   (select sum(strftime('%s',coalesce(end,current_timestamp))-strftime('%s',start)) sum_duration
 	from entries e
 	where e.header_id = h.header_id
   and start between ? and ?) sum_duration
 from headers h
+left join header_tree t on t.header_id = h.header_id
 where sum_duration is not null
-and lower(header) like lower('%'||?||'%')
+and lower(coalesce(t.path, h.header)) like lower('%'||?||'%')
 and h.active=1
 order by sum_duration desc
 `, from, to, filter)
@@ -1050,6 +1061,8 @@ order by sum_duration desc
 	defer checkDBErr(rows)
 	total := time.Duration(0)
 	rounderr := time.Duration(0)
+	sums := make(map[string]time.Duration)
+	handles := make(map[string]string)
 
 	fmt.Println("Headers:", printTimeFrame(&from, &to))
 	for rows.Next() {
@@ -1064,24 +1077,69 @@ order by sum_duration desc
 		diff := dur - rounded
 		dur = rounded
 		rounderr += diff
-		fmt.Printf("%21s%s  %s\n", formatDuration(dur), formatRoundErr(diff), formatHeader(head, handle))
+		if withSub {
+			sums[head] += dur
+			handles[head] = handle
+		} else {
+			fmt.Printf("%21s%s  %s\n", formatDuration(dur), formatRoundErr(diff), formatHeader(head, handle))
+		}
 		total += dur
 	}
+	if withSub {
+		addSubtotals(sums)
+		for _, head := range sortedKeys(sums) {
+			fmt.Printf("%21s  %s\n", formatDuration(sums[head]), formatHeader(subheaderLabel(head), handles[head]))
+		}
+	}
 	fmt.Printf("     Total: %9s%s\n", formatDuration(total), formatRoundErr(rounderr))
 	return nil
 }
 
+// addSubtotals adds the time of the sub-headers A:B:C to A:B and A.
+func addSubtotals(sums map[string]time.Duration) {
+	for header, dur := range copyDurations(sums) {
+		headerParts := strings.Split(header, ":")
+		for i := 1; i < len(headerParts); i++ {
+			sums[strings.Join(headerParts[:i], ":")] += dur
+		}
+	}
+}
+
+func copyDurations(sums map[string]time.Duration) map[string]time.Duration {
+	c := make(map[string]time.Duration, len(sums))
+	for k, v := range sums {
+		c[k] = v
+	}
+	return c
+}
+
+func sortedKeys(sums map[string]time.Duration) []string {
+	keys := make([]string, 0, len(sums))
+	for k := range sums {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// subheaderLabel shows the last part of A:B:C, indented by the level.
+func subheaderLabel(header string) string {
+	headerParts := strings.Split(header, ":")
+	return strings.Repeat("  ", len(headerParts)-1) + headerParts[len(headerParts)-1]
+}
+
 func QueryDays(db *sql.DB, from, to time.Time, filter string, rounding time.Duration, bias time.Duration) ([]TimeDurationEntry, error) {
 	rows := dbQ(db.Query, `
-with b as (select h.header, h.handle, date(start) start_date, (strftime('%s',end)-strftime('%s',start)) duration
+with b as (select coalesce(t.path, h.header) header, coalesce(h.handle,'') handle, coalesce(t.depth, 0) depth, date(start) start_date, (strftime('%s',end)-strftime('%s',start)) duration
 from entries e
 join headers h on h.header_id = e.header_id and h.active=1
+left join header_tree t on t.header_id = h.header_id
 where e.end is not null
 and e.start between ? and ?)
-select start_date, header, handle, sum(duration)
+select start_date, header, handle, depth, sum(duration)
 from b
 where lower(header) like lower('%'||?||'%')
-group by header, handle, start_date
+group by header, handle, depth, start_date
 order by start_date asc
 `, from, to, filter)
 	defer rows.Close()
@@ -1094,7 +1152,7 @@ order by start_date asc
 
 	for rows.Next() {
 		var e TimeDurationEntry
-		rows.Scan(&e.Start, &e.Head, &e.Handle, &e.Duration)
+		rows.Scan(&e.Start, &e.Head, &e.Handle, &e.Depth, &e.Duration)
 		dur := time.Duration(e.Duration * 1000000000)
 		rounded := DurationRound(dur, rounding, bias)
 		diff := dur - rounded
@@ -1189,9 +1247,7 @@ func printWeek(week headerDays, title string) {
 	for _, header := range keys {
 		row = table.NewRow()
 		if withSub {
-			headerParts := strings.Split(header, ":")
-			s := strings.Repeat("  ", len(headerParts)-1) + headerParts[len(headerParts)-1]
-			row = row.Add(table.Cell{s, table.Left})
+			row = row.Add(table.Cell{subheaderLabel(header), table.Left})
 		} else {
 			row = row.Add(table.Cell{header, table.Left})
 		}
@@ -1237,9 +1293,10 @@ func ShowWeek(db *sql.DB, timeFrame string, argv []string) error {
 	//fmt.Println("From, to:", from, to)
 	rows := dbQ(db.Query, `
 with p as (select ? pfrom, ? pto),
-b as (select h.header, h.handle, date(start) start_date, (strftime('%s',coalesce(end,current_timestamp))-strftime('%s',start)) duration
+b as (select coalesce(t.path, h.header) header, coalesce(h.handle,'') handle, date(start) start_date, (strftime('%s',coalesce(end,current_timestamp))-strftime('%s',start)) duration
 from entries e
 join headers h on h.header_id = e.header_id and h.active=1
+left join header_tree t on t.header_id = h.header_id
 join p
 where 1=1 --e.end is not null
 and e.start between p.pfrom and p.pto)
@@ -1301,9 +1358,10 @@ func ShowDays(db *sql.DB, timeFrame string, argv []string) error {
 	//fmt.Println("From, to:", from, to)
 	rows := dbQ(db.Query, `
 with p as (select ? pfrom, ? pto),
-b as (select h.header, h.handle, date(start) start_date, (strftime('%s',coalesce(end,current_timestamp))-strftime('%s',start)) duration
+b as (select coalesce(t.path, h.header) header, coalesce(h.handle,'') handle, date(start) start_date, (strftime('%s',coalesce(end,current_timestamp))-strftime('%s',start)) duration
 from entries e
 join headers h on h.header_id = e.header_id and h.active=1
+left join header_tree t on t.header_id = h.header_id
 join p
 where 1=1 --e.end is not null
 and e.start between p.pfrom and p.pto)
@@ -1319,6 +1377,10 @@ order by header, start_date asc
 	total := time.Duration(0)
 	rounderr := time.Duration(0)
 
+	withSub := viper.GetBool("show.subheaders")
+	daySums := make(map[string]map[string]time.Duration)
+	handles := make(map[string]string)
+
 	fmt.Println("Daily:", printTimeFrame(&from, &to))
 	for rows.Next() {
 		var start string //time.Time //string
@@ -1334,9 +1396,28 @@ order by header, start_date asc
 		diff := dur - rounded
 		rounderr += diff
 		dur = rounded
-		fmt.Printf("%s: %9s%s  %s\n", start, formatDuration(dur), formatRoundErr(diff), formatHeader(head, handle))
+		if withSub {
+			if daySums[start] == nil {
+				daySums[start] = make(map[string]time.Duration)
+			}
+			daySums[start][head] += dur
+			handles[head] = handle
+		} else {
+			fmt.Printf("%s: %9s%s  %s\n", start, formatDuration(dur), formatRoundErr(diff), formatHeader(head, handle))
+		}
 		total += dur
 	}
+	dates := make([]string, 0, len(daySums))
+	for day := range daySums {
+		dates = append(dates, day)
+	}
+	sort.Strings(dates)
+	for _, day := range dates {
+		addSubtotals(daySums[day])
+		for _, head := range sortedKeys(daySums[day]) {
+			fmt.Printf("%s: %9s  %s\n", day, formatDuration(daySums[day][head]), formatHeader(subheaderLabel(head), handles[head]))
+		}
+	}
 	fmt.Printf("     Total: %9s%s\n", formatDuration(total), formatRoundErr(rounderr))
 	return nil
 }
@@ -1350,11 +1431,12 @@ func ShowOrg(db *sql.DB, argv []string) error {
 	if len(argv) > 1 {
 		filter = argv[1]
 	}
-	hdrs := dbQ(db.Query, `select header_id, header
-	from headers
-	where active=1
-	and lower(header) like lower('%'||?||'%')
-	and header_id in (select header_id
+	hdrs := dbQ(db.Query, `select h.header_id, coalesce(t.path, h.header)
+	from headers h
+	left join header_tree t on t.header_id = h.header_id
+	where h.active=1
+	and lower(coalesce(t.path, h.header)) like lower('%'||?||'%')
+	and h.header_id in (select header_id
 	from entries where
 		(start between ? and ? or (end is null and current_timestamp between ? and ?)))`, filter, from, to, from, to)
 	defer hdrs.Close()
@@ -1409,10 +1491,11 @@ func ShowLedger(db *sql.DB, argv []string) (err error) {
 	if len(argv) > 1 {
 		filter = argv[1]
 	}
-	entr := dbQ(db.Query, `select h.header_id, h.header, h.handle, e.start, e.end
+	entr := dbQ(db.Query, `select h.header_id, coalesce(t.path, h.header), h.handle, e.start, e.end
 		from entries e
                 join headers h on h.header_id = e.header_id
-		where lower(header) like lower('%'||?||'%')
+		left join header_tree t on t.header_id = h.header_id
+		where lower(coalesce(t.path, h.header)) like lower('%'||?||'%')
 		and (start between ? and ? or (end is null and current_timestamp between ? and ?))
 		order by h.header_id, e.start asc`, filter, from, to, from, to)
 	defer entr.Close()
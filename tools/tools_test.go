@@ -1,7 +1,13 @@
 package tools
 
 import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func assert(t *testing.T, assertion bool, expectation string) {
@@ -10,7 +16,207 @@ func assert(t *testing.T, assertion bool, expectation string) {
 	}
 }
 
+// testDB opens an initialized clockfile in memory. A single connection,
+// every connection to :memory: would get its own database.
+func testDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	testTx(t, db, func(tx *sql.Tx) { PrepareDB(db, tx) })
+	return db
+}
+
+// testTx runs fn in a committed transaction.
+func testTx(t *testing.T, db *sql.DB, fn func(*sql.Tx)) {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RollbackOnError(tx)
+	fn(tx)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// count gives the result of a select count(*) query.
+func count(t *testing.T, tx *sql.Tx, query string, args ...interface{}) int {
+	var n int
+	if err := tx.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
 func TestUUID(t *testing.T) {
 	uuid := newUUID()
 	assert(t, uuid != "", "uuid is not empty")
 }
+
+func TestParseTimeRange(t *testing.T) {
+	now := time.Date(2016, 10, 12, 17, 0, 0, 0, time.Local)
+	start, end, rest, err := ParseTimeRange([]string{"yesterday", "13:00-14:15"}, now)
+	assert(t, err == nil, "range is parsed")
+	assert(t, start.Equal(time.Date(2016, 10, 11, 13, 0, 0, 0, time.Local)), "start yesterday 13:00")
+	assert(t, end.Sub(start) == 75*time.Minute, "range lasts 1h15m")
+	assert(t, len(rest) == 0, "nothing remains")
+
+	start, end, _, err = ParseTimeRange([]string{"2016-10-03", "9:00", "1h30m"}, now)
+	assert(t, err == nil, "duration is parsed")
+	assert(t, start.Equal(time.Date(2016, 10, 3, 9, 0, 0, 0, time.Local)), "start 2016-10-03 9:00")
+	assert(t, end.Equal(time.Date(2016, 10, 3, 10, 30, 0, 0, time.Local)), "end 10:30")
+
+	start, end, rest, err = ParseTimeRange([]string{"Meeting", "13:00", "15:00"}, now)
+	assert(t, err == nil, "start and end are parsed")
+	assert(t, end.Sub(start) == 2*time.Hour, "end is on the same day")
+	assert(t, len(rest) == 1 && rest[0] == "Meeting", "header text remains")
+
+	_, _, _, err = ParseTimeRange([]string{"09:00-08:00"}, now)
+	assert(t, err != nil, "an end before the start is refused")
+	start, end, _, err = ParseTimeRange([]string{"23:00", "2h"}, now)
+	assert(t, err == nil && end.Day() == start.Day()+1, "a duration goes past midnight")
+
+	_, _, _, err = ParseTimeRange([]string{"13:00"}, now)
+	assert(t, err != nil, "a single time is refused")
+}
+
+func TestOrgHeaderTitle(t *testing.T) {
+	assert(t, orgHeaderTitle([]string{"Customer 1   :work:", "Development"}) == "Customer 1:Development", "tags are removed")
+	assert(t, orgHeaderTitle([]string{"Hobby", "", "Deep one"}) == "Hobby:Deep one", "skipped levels are ignored")
+}
+
+func TestImportOrgFileReusesNewHeader(t *testing.T) {
+	org := filepath.Join(t.TempDir(), "time.org")
+	os.WriteFile(org, []byte(`* Proj
+** Dev
+   CLOCK: [2016-10-03 Mon 09:00]--[2016-10-03 Mon 10:00] =>  1:00
+   CLOCK: [2016-10-04 Tue 09:00]--[2016-10-04 Tue 10:00] =>  1:00
+* Other
+* Proj
+** Dev
+   CLOCK: [2016-10-05 Wed 09:00]--[2016-10-05 Wed 10:00] =>  1:00
+`), 0644)
+	db := testDB(t)
+	testTx(t, db, func(tx *sql.Tx) {
+		assert(t, ImportOrgFile(tx, org, true) == nil, "dry run")
+		assert(t, count(t, tx, `select count(*) from entries`) == 0, "dry run stores nothing")
+		assert(t, ImportOrgFile(tx, org, false) == nil, "import")
+		dev := findHeaderByTitle(tx, "Proj:Dev")
+		assert(t, dev != 0, "header is created")
+		assert(t, count(t, tx, `select count(*) from entries where header_id = ?`, dev) == 3,
+			"both clock blocks are stored under the new header")
+		assert(t, count(t, tx, `select count(*) from headers where header = 'Dev'`) == 1, "the header is created once")
+		assert(t, ImportOrgFile(tx, org, false) == nil, "repeated import")
+		assert(t, count(t, tx, `select count(*) from entries`) == 3, "nothing is imported twice")
+	})
+}
+
+func TestHeaderCycles(t *testing.T) {
+	db := testDB(t)
+	start := time.Date(2016, 10, 3, 9, 0, 0, 0, time.Local)
+	end := start.Add(time.Hour)
+	testTx(t, db, func(tx *sql.Tx) {
+		_, err := AddHeader(tx, "A:C:B", "", "")
+		assert(t, err == nil, "headers are created")
+		assert(t, MergeHeaders(tx, "A", "A:C:B") != nil, "a header is not merged into its sub-header")
+		assert(t, MergeHeaders(tx, "A:C:B", "A") == nil, "a sub-header is merged into its parent")
+		b, _ := AddHeader(tx, "B", "", "")
+		addTime(tx, orgEntry{start: &start, end: &end}, b)
+		// a cycle as it might come from elsewhere
+		_ = dbX(tx.Exec, `update headers set parent_uuid = (select header_uuid from headers where header = 'C')
+		where header_id = ?`, b)
+		_ = dbX(tx.Exec, `update headers set parent_uuid = (select header_uuid from headers where header_id = ?)
+		where header = 'C'`, b)
+		var uuid string
+		tx.QueryRow(`select header_uuid from headers where header_id = ?`, b).Scan(&uuid)
+		assert(t, !isBelow(tx, uuid, "A"), "the parents of a cycle are followed once")
+	})
+	days, err := QueryDays(db, start.Add(-time.Hour), end, "", 0, 0)
+	assert(t, err == nil && len(days) == 1, "entries of headers in a cycle are reported")
+	assert(t, len(days) == 1 && days[0].Head == "B" && days[0].Duration == 3600, "under the header title")
+}
+
+func TestQueriesUsePath(t *testing.T) {
+	db := testDB(t)
+	start := time.Now().Add(-3 * time.Hour).Round(time.Minute)
+	end := start.Add(time.Hour)
+	testTx(t, db, func(tx *sql.Tx) {
+		dev, _ := AddHeader(tx, "Proj:Dev", "dev", "")
+		addTime(tx, orgEntry{start: &start, end: &end}, dev)
+		addTime(tx, orgEntry{start: &end}, dev)
+		running := RunningEntries(tx, time.Now())
+		assert(t, len(running) == 1 && running[0].Header == "Proj:Dev", "running entries have the path")
+		headers := QueryHeaders(tx, "Proj:D")
+		assert(t, len(headers) == 1 && headers[0].Header == "Proj:Dev", "headers have the path")
+		recent := RecentHeaders(tx, 1)
+		assert(t, len(recent) == 1 && recent[0].Header == "Proj:Dev", "recent headers have the path")
+	})
+	days, _ := QueryDays(db, start.Add(-time.Hour), end, "", 0, 0)
+	assert(t, len(days) == 1 && days[0].Head == "Proj:Dev", "days have the path")
+}
+
+func TestICSLine(t *testing.T) {
+	assert(t, icsLine("BEGIN:VEVENT") == "BEGIN:VEVENT\r\n", "short lines are not folded")
+	folded := icsLine("DESCRIPTION:" + strings.Repeat("ö", 80))
+	lines := strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n ")
+	assert(t, len(lines) == 3, "long line is folded")
+	for _, l := range lines {
+		assert(t, len(l) <= 75 && utf8.ValidString(l), "folded lines are at most 75 octets of valid UTF-8")
+	}
+	assert(t, icsEscaper.Replace("a;b,c\\d\ne") == `a\;b\,c\\d\ne`, "text is escaped")
+}
+
+func TestExportICSPath(t *testing.T) {
+	db := testDB(t)
+	start := time.Date(2016, 10, 3, 9, 0, 0, 0, time.Local)
+	end := start.Add(time.Hour)
+	testTx(t, db, func(tx *sql.Tx) {
+		hdr, _ := AddHeader(tx, "Customer:Project", "", "")
+		addTime(tx, orgEntry{start: &start, end: &end}, hdr)
+	})
+	var cal strings.Builder
+	assert(t, ExportICS(db, &cal, start.Add(-time.Hour), end, "customer") == nil, "calendar is exported")
+	assert(t, strings.Contains(cal.String(), "SUMMARY:Customer:Project"), "the filter and summary use the path")
+}
+
+func TestParseICS(t *testing.T) {
+	cal := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nSUMMARY:Daily stand\r\n up\\, team\r\n" +
+		"DTSTART:20161003T090000\r\nDURATION:PT15M\r\nRRULE:FREQ=WEEKLY;BYDAY=MO,WE;COUNT=3\r\n" +
+		"EXDATE:20161005T090000\r\nBEGIN:VALARM\r\nSUMMARY:ignored\r\nEND:VALARM\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	events, err := parseICS(strings.NewReader(cal))
+	assert(t, err == nil && len(events) == 1, "one event is parsed")
+	assert(t, events[0].summary == "Daily standup, team", "folded summary is unescaped")
+	assert(t, events[0].end.Sub(events[0].start) == 15*time.Minute, "duration gives the end")
+	from := time.Date(2016, 10, 1, 0, 0, 0, 0, time.Local)
+	occ := icsOccurrences(events, from, from.AddDate(0, 1, 0))
+	assert(t, len(occ) == 2, "three recurrences minus one exception")
+	assert(t, occ[1].start.Equal(time.Date(2016, 10, 10, 9, 0, 0, 0, time.Local)), "second is next monday")
+}
+
+func TestHeaderAttrs(t *testing.T) {
+	billable := true
+	parent := headerAttrs{client: "ACME", billable: &billable, rate: 95, currency: "EUR", budget: time.Hour}
+	a := headerAttrs{rate: 110}.inherit(parent)
+	assert(t, a.client == "ACME" && a.billable == &billable, "client and billable are inherited")
+	assert(t, a.rate == 110 && a.currency == "EUR", "own rate in the parent's currency")
+	assert(t, a.budget == 0, "the budget is not inherited")
+	budget, err := parseBudget("40")
+	assert(t, err == nil && budget == 40*time.Hour, "a number is hours")
+	budget, err = parseBudget("1h30m")
+	assert(t, err == nil && budget == 90*time.Minute, "a duration is parsed")
+}
+
+func TestBudgetExhaustion(t *testing.T) {
+	now := time.Date(2016, 10, 12, 17, 0, 0, 0, time.Local)
+	week := 7 * 24 * time.Hour
+	b := budgetStatus{budget: 40 * time.Hour, used: 30 * time.Hour, recent: 5 * time.Hour}
+	day, ok := b.exhaustion(now, week)
+	assert(t, ok && day.Equal(now.Add(2*week)), "10h left at 5h a week last two weeks")
+	assert(t, b.percent() == 75, "75% used")
+	b.recent = 0
+	_, ok = b.exhaustion(now, week)
+	assert(t, !ok, "no projection without recent time")
+}